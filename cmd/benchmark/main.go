@@ -7,6 +7,9 @@ import (
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,11 +19,21 @@ import (
 func main() {
 	directory := flag.String("directory", "", "serve this directory of ebook files")
 	fromDisk := flag.Bool("from-disk", false, "read corpus from disk each time instead of memory")
+	pageCacheMb := flag.Int("page-cache-mb", 0, "with -from-disk, keep up to this many megabytes of texts in memory between reads")
+	repeat := flag.Int("repeat", 1, "run the query this many times, reporting the timings of the last run (e.g., to warm up -page-cache-mb)")
+	loader := flag.String("loader", "read", "how to load the corpus: 'read' (into memory), 'mmap' (memory-mapped), 'packed' (from the packed corpus built by cmd/pack), or 'compressed' (from the compressed corpus built by cmd/pack -compress)")
 	query := flag.String("query", "", "keyword to query")
+	multi := flag.Bool("multi", false, "treat -query as a comma-separated list of keywords, and compare searching for them one at a time with searching for all of them at once")
 	takeProfile := flag.Bool("profile", false, "take a pprof profile")
 	maxGoroutines := flag.Int("max-goroutines", -1, "use this many goroutines (-1 for no limit -- the default, 0 for 1 per CPU core)")
 	measureBaseline := flag.Bool("measure-baseline", false, "measure baseline performance")
 	results := flag.Int("results", 0, "show this many results (-1 for all, 0 for none)")
+	perBook := flag.Int("per-book", 0, "return at most this many results from each book (0 for no limit)")
+	finder := flag.String("finder", concordance.FINDER_AUTO, fmt.Sprintf("search algorithm: %s, or %s to choose one for the query", strings.Join(concordance.FinderNames(), ", "), concordance.FINDER_AUTO))
+	useBloom := flag.Bool("bloom", false, "build a Bloom filter of each text's trigrams after loading, to skip texts that can't match")
+	useIndex := flag.Bool("index", false, "answer single-word queries from the inverted index (built if needed)")
+	chunkSize := flag.Int("chunk-size", 0, "split books into chunks of this many bytes (0 for the default, -1 to search whole books)")
+	verifyIndex := flag.Bool("verify-index", false, "with -index, check the results against a full scan")
 	flag.Parse()
 
 	if *directory == "" {
@@ -36,7 +49,46 @@ func main() {
 			os.Exit(1)
 		}
 
-		runOneQuery(*query, *directory, *takeProfile, *maxGoroutines, *results, *fromDisk)
+		if !concordance.IsFinderName(*finder) {
+			fmt.Fprintf(os.Stderr, "unknown finder: %s\n", *finder)
+			os.Exit(1)
+		}
+
+		if *finder == "index" && !*useIndex {
+			fmt.Fprintln(os.Stderr, "-finder index requires -index")
+			os.Exit(1)
+		}
+
+		if *pageCacheMb > 0 && (!*fromDisk || *loader != "read") {
+			fmt.Fprintln(os.Stderr, "-page-cache-mb requires -from-disk and -loader read")
+			os.Exit(1)
+		}
+
+		if *finder == "suffix-array" {
+			fmt.Fprintln(os.Stderr, "the benchmark doesn't support -finder suffix-array")
+			os.Exit(1)
+		}
+
+		options := QueryOptions{
+			TakeProfile:   *takeProfile,
+			MaxGoroutines: *maxGoroutines,
+			Results:       *results,
+			FromDisk:      *fromDisk,
+			PageCacheMb:   *pageCacheMb,
+			Repeat:        *repeat,
+			Loader:        *loader,
+			PerBook:       *perBook,
+			ChunkSize:     *chunkSize,
+			Finder:        *finder,
+			UseBloom:      *useBloom,
+			UseIndex:      *useIndex,
+			VerifyIndex:   *verifyIndex,
+		}
+		if *multi {
+			runMultiQuery(strings.Split(*query, ","), *directory, options)
+		} else {
+			runOneQuery(*query, *directory, options)
+		}
 	}
 }
 
@@ -116,15 +168,87 @@ func runMeasureBaseline(directory string, maxGoroutines int) {
 	fmt.Printf("duration: %d ms\n", durationMillis)
 }
 
-func runOneQuery(query string, directory string, takeProfile bool, maxGoroutines int, results int, fromDisk bool) {
-	pages, err := concordance.LoadPages(directory, fromDisk, -1)
+type QueryOptions struct {
+	TakeProfile   bool
+	MaxGoroutines int
+	Results       int
+	FromDisk      bool
+	PageCacheMb   int
+	Repeat        int
+	Loader        string
+	PerBook       int
+	ChunkSize     int
+	Finder        string
+	UseBloom      bool
+	UseIndex      bool
+	VerifyIndex   bool
+}
+
+func runOneQuery(query string, directory string, options QueryOptions) {
+	loadStartTime := time.Now()
+	var pages concordance.Pages
+	var err error
+	var pageCache *concordance.PageCache
+	// for the loaders that map a single file
+	corpusPath := ""
+	switch options.Loader {
+	case "read":
+		if options.PageCacheMb > 0 {
+			pageCache = concordance.NewPageCache(int64(options.PageCacheMb) * 1024 * 1024)
+			pages, err = concordance.LoadPagesCached(directory, -1, pageCache)
+		} else {
+			pages, err = concordance.LoadPages(directory, options.FromDisk, -1)
+		}
+	case "mmap":
+		pages, err = concordance.LoadPagesMmap(directory, options.FromDisk, -1)
+		defer pages.Close()
+	case "packed":
+		corpusPath = fmt.Sprintf("%s/%s", directory, concordance.PACKED_FILE_NAME)
+		pages, err = concordance.LoadPacked(corpusPath)
+		defer pages.Close()
+	case "compressed":
+		corpusPath = fmt.Sprintf("%s/%s", directory, concordance.COMPRESSED_FILE_NAME)
+		pages, err = concordance.LoadCompressed(corpusPath)
+		defer pages.Close()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown loader: %s\n", options.Loader)
+		os.Exit(1)
+	}
 	if err != nil {
 		panic(err)
 	}
+	loadDurationMs := time.Since(loadStartTime).Milliseconds()
+
+	if options.UseBloom {
+		concordance.BuildSignatures(pages)
+	}
+
+	var index *concordance.Index
+	if options.UseIndex {
+		index, err = concordance.LoadOrBuildIndex(directory, pages)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// The earlier runs are only there to warm up caches.
+	quitChannel := make(chan struct{})
+	searchOptions := concordance.SearchOptions{MaxGoroutines: options.MaxGoroutines, PerPageLimit: options.PerBook, ChunkSize: options.ChunkSize, Finder: options.Finder, Index: index}
+	warmUpMs := []int64{}
+	for i := 1; i < options.Repeat; i++ {
+		runStartTime := time.Now()
+		ch, _, err := concordance.StreamSearch(pages, query, quitChannel, searchOptions)
+		if err != nil {
+			panic(err)
+		}
+		for range ch {
+		}
+		warmUpMs = append(warmUpMs, time.Since(runStartTime).Milliseconds())
+	}
 
 	startTime := time.Now()
 
-	if takeProfile {
+	if options.TakeProfile {
 		profFile, err := os.Create("fast.perf")
 		defer func() { profFile.Close() }()
 		if err != nil {
@@ -133,8 +257,11 @@ func runOneQuery(query string, directory string, takeProfile bool, maxGoroutines
 		pprof.StartCPUProfile(profFile)
 	}
 
-	quitChannel := make(chan struct{})
-	ch, err := concordance.StreamSearch(pages, query, quitChannel, maxGoroutines)
+	finderName := options.Finder
+	if finderName == concordance.FINDER_AUTO {
+		finderName = concordance.ChooseFinder(query, pages, searchOptions)
+	}
+	ch, stats, err := concordance.StreamSearch(pages, query, quitChannel, searchOptions)
 	if err != nil {
 		panic(err)
 	}
@@ -142,28 +269,184 @@ func runOneQuery(query string, directory string, takeProfile bool, maxGoroutines
 	var durationToFirstMs int64 = -1
 	n := 0
 	resultsShown := 0
-	for match := range ch {
-		if durationToFirstMs == -1 {
-			durationToFirstMs = time.Since(startTime).Milliseconds()
-		}
+	matches := []concordance.Match{}
+	for batch := range ch {
+		for _, match := range batch {
+			if durationToFirstMs == -1 {
+				durationToFirstMs = time.Since(startTime).Milliseconds()
+			}
 
-		jsonB, err := json.Marshal(match)
-		if err != nil {
-			continue
-		}
+			if options.VerifyIndex {
+				matches = append(matches, match)
+			}
 
-		if resultsShown < results {
-			fmt.Println(string(jsonB))
-			resultsShown += 1
+			jsonB, err := json.Marshal(match)
+			if err != nil {
+				continue
+			}
+
+			if resultsShown < options.Results {
+				fmt.Println(string(jsonB))
+				resultsShown += 1
+			}
+			n += 1
 		}
-		n += 1
 	}
 	durationMs := time.Since(startTime).Milliseconds()
-	if takeProfile {
+	if options.TakeProfile {
 		pprof.StopCPUProfile()
 	}
 
+	suppressed := 0
+	for _, m := range stats.Suppressed {
+		suppressed += m
+	}
+
+	fmt.Printf("finder:  %s\n", finderName)
 	fmt.Printf("results: %d\n", n)
+	if options.UseBloom {
+		fmt.Printf("skipped: %d of %d book(s)\n", stats.SkippedPages, len(pages.Pages))
+	}
+	if stats.Blocks > 0 {
+		fmt.Printf("skipped: %d of %d block(s)\n", stats.SkippedBlocks, stats.Blocks)
+	}
+	if options.PerBook > 0 {
+		fmt.Printf("suppressed: %d (in %d book(s))\n", suppressed, len(stats.Suppressed))
+	}
+	fmt.Printf("load:    % 6d ms\n", loadDurationMs)
 	fmt.Printf("first:   % 6d ms\n", durationToFirstMs)
 	fmt.Printf("last:    % 6d ms\n", durationMs)
+	for i, ms := range warmUpMs {
+		fmt.Printf("run %d:   % 6d ms\n", i+1, ms)
+	}
+
+	if pageCache != nil {
+		cacheStats := pageCache.Stats()
+		fmt.Printf("cache:   %d hit(s), %d miss(es), %d eviction(s), %d of %d page(s) (%d MB) resident\n", cacheStats.Hits, cacheStats.Misses, cacheStats.Evictions, cacheStats.Pages, len(pages.Pages), cacheStats.Bytes/1024/1024)
+	}
+
+	// The slowest chunks are the stragglers that the last result waits for.
+	if len(stats.ChunkDurations) > 0 {
+		slices.Sort(stats.ChunkDurations)
+		fmt.Printf("chunks:  % 6d\n", len(stats.ChunkDurations))
+		fmt.Printf("p50:     % 6d µs\n", percentile(stats.ChunkDurations, 50).Microseconds())
+		fmt.Printf("p99:     % 6d µs\n", percentile(stats.ChunkDurations, 99).Microseconds())
+		fmt.Printf("max:     % 6d µs\n", stats.ChunkDurations[len(stats.ChunkDurations)-1].Microseconds())
+	}
+	fmt.Printf("scanned: % 6d MB in %d book(s)\n", stats.BytesScanned/1024/1024, stats.PagesScanned)
+	fmt.Printf("hits:    % 6d candidate(s), %d not on word boundaries\n", stats.Candidates, stats.Rejected)
+	fmt.Printf("cpu:     % 6d ms\n", stats.CpuTime.Milliseconds())
+
+	// Mapped texts don't count towards the heap, which is the point of `-loader mmap`.
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	fmt.Printf("heap:    % 6d MB\n", memStats.HeapAlloc/1024/1024)
+	if corpusPath != "" {
+		info, err := os.Stat(corpusPath)
+		if err == nil {
+			fmt.Printf("file:    % 6d MB\n", info.Size()/1024/1024)
+		}
+	}
+
+	if options.VerifyIndex {
+		if index == nil || !concordance.IsIndexable(query) {
+			fmt.Println("verify:  skipped (index not used for this query)")
+		} else {
+			verifyResults(pages, query, searchOptions, matches)
+		}
+	}
+}
+
+// runMultiQuery compares N sequential `StreamSearch` calls with one `StreamSearchMulti` call.
+func runMultiQuery(keywords []string, directory string, options QueryOptions) {
+	pages, err := concordance.LoadPages(directory, options.FromDisk, -1)
+	if err != nil {
+		panic(err)
+	}
+
+	searchOptions := concordance.SearchOptions{MaxGoroutines: options.MaxGoroutines, PerPageLimit: options.PerBook, ChunkSize: options.ChunkSize, Finder: options.Finder}
+	if options.UseBloom {
+		concordance.BuildSignatures(pages)
+	}
+
+	startTime := time.Now()
+	sequential := 0
+	for _, keyword := range keywords {
+		ch, _, err := concordance.StreamSearch(pages, keyword, make(chan struct{}), searchOptions)
+		if err != nil {
+			panic(err)
+		}
+		for batch := range ch {
+			sequential += len(batch)
+		}
+	}
+	sequentialMs := time.Since(startTime).Milliseconds()
+
+	startTime = time.Now()
+	ch, _, err := concordance.StreamSearchMulti(pages, keywords, make(chan struct{}), searchOptions)
+	if err != nil {
+		panic(err)
+	}
+	byPattern := make(map[string]int)
+	for batch := range ch {
+		for _, match := range batch {
+			byPattern[match.Pattern] += 1
+		}
+	}
+	multiMs := time.Since(startTime).Milliseconds()
+
+	multi := 0
+	for _, n := range byPattern {
+		multi += n
+	}
+	for _, keyword := range keywords {
+		fmt.Printf("%-20s % 8d\n", keyword, byPattern[keyword])
+	}
+	fmt.Printf("sequential: % 6d result(s) in % 6d ms\n", sequential, sequentialMs)
+	fmt.Printf("multi:      % 6d result(s) in % 6d ms\n", multi, multiMs)
+}
+
+// percentile returns the `p`th percentile (nearest-rank) of `sorted`, which must not be
+// empty.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[max(0, (len(sorted)*p+99)/100-1)]
+}
+
+// verifyResults checks `matches` against the results of a full scan of the corpus.
+func verifyResults(pages concordance.Pages, query string, options concordance.SearchOptions, matches []concordance.Match) {
+	options.Finder = "regexp"
+	options.Index = nil
+	ch, _, err := concordance.StreamSearch(pages, query, make(chan struct{}), options)
+	if err != nil {
+		panic(err)
+	}
+
+	expected := []concordance.Match{}
+	for batch := range ch {
+		for _, match := range batch {
+			expected = append(expected, match)
+		}
+	}
+
+	sortMatches(matches)
+	sortMatches(expected)
+	if !slices.Equal(matches, expected) {
+		fmt.Printf("verify:  FAILED (%d result(s), but full scan found %d)\n", len(matches), len(expected))
+		os.Exit(1)
+	}
+	fmt.Println("verify:  ok")
+}
+
+func sortMatches(matches []concordance.Match) {
+	sort.Slice(matches, func(i, j int) bool {
+		a := matches[i]
+		b := matches[j]
+		if a.FileName != b.FileName {
+			return a.FileName < b.FileName
+		}
+		if a.Left != b.Left {
+			return a.Left < b.Left
+		}
+		return a.Right < b.Right
+	})
 }
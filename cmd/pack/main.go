@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/iafisher/fast-concordance/internal/concordance"
+)
+
+func main() {
+	directory := flag.String("directory", "", "pack this directory of ebook files")
+	output := flag.String("output", "", "write the packed corpus to this file (default: corpus.pack, or corpus.packz with -compress, in -directory)")
+	compress := flag.Bool("compress", false, "write a compressed corpus instead, which is smaller but slower to search")
+	limitTexts := flag.Int("limit-texts", -1, "only include a subset of texts")
+	flag.Parse()
+
+	if *directory == "" {
+		fmt.Fprintln(os.Stderr, "-directory is required")
+		os.Exit(1)
+	}
+
+	path := *output
+	if path == "" && *compress {
+		path = fmt.Sprintf("%s/%s", *directory, concordance.COMPRESSED_FILE_NAME)
+	} else if path == "" {
+		path = fmt.Sprintf("%s/%s", *directory, concordance.PACKED_FILE_NAME)
+	}
+
+	pages, err := concordance.LoadPages(*directory, false, *limitTexts)
+	if err != nil {
+		log.Fatalf("could not load pages: %v", err)
+	}
+
+	if *compress {
+		err = concordance.WriteCompressed(pages, path)
+	} else {
+		err = concordance.WritePacked(pages, path)
+	}
+	if err != nil {
+		log.Fatalf("could not write packed corpus: %v", err)
+	}
+	log.Printf("wrote %d text(s) to %s", len(pages.Pages), path)
+}
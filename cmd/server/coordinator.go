@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/iafisher/fast-concordance/internal/concordance"
+	"github.com/iafisher/fast-concordance/internal/shard"
+)
+
+// ServerWarningMessage is written when some of the results are missing, e.g. because a shard
+// failed, before the trailer (which says that the results are partial).
+type ServerWarningMessage struct {
+	Warning ServerWarning `json:"warning"`
+}
+
+type ServerWarning struct {
+	Message string `json:"message"`
+	// for the warning that an expensive query is answered with a sample or a count instead
+	// (see `-expensive-queries`), `EXPENSIVE_SAMPLE` or `EXPENSIVE_COUNT`, so that a
+	// coordinator knows before the matches arrive
+	Downgraded string `json:"downgraded,omitempty"`
+}
+
+// coordinatorHandler returns the handler for a coordinator, which holds no texts itself and
+// answers concordance queries by passing them on to the shard servers in `config.Shards`
+// (started with `-shard`) and merging their results.
+func coordinatorHandler(config ServerConfig) *http.ServeMux {
+	handler := &http.ServeMux{}
+	client := &http.Client{}
+
+	handler.HandleFunc("/concord", func(writer http.ResponseWriter, req *http.Request) {
+		handleCoordinatedConcord(config, client, writer, req)
+	})
+	handler.HandleFunc("/manifest", func(writer http.ResponseWriter, req *http.Request) {
+		handleCoordinatedManifest(config, client, writer, req)
+	})
+	handler.HandleFunc("/", handleIndex)
+	handler.HandleFunc("/static/fast.js", handleJs)
+	handler.HandleFunc("/static/fast.css", handleCss)
+	return handler
+}
+
+func handleCoordinatedConcord(config ServerConfig, client *http.Client, writer http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	query := req.URL.Query()
+	keyword := query.Get("w")
+
+	if !checkKeyword(writer, keyword) {
+		return
+	}
+
+	// A sample can't be put together from samples of the shards without knowing how many hits
+	// each one had.
+	if query.Has("sample") {
+		writeError(writer, "The sample parameter is not supported by this server.")
+		return
+	}
+
+	perBook, ok := parseIntParam(writer, query, "per_book", 0, 1, MAX_PER_BOOK)
+	if !ok {
+		return
+	}
+
+	maxResults, ok := parseIntParam(writer, query, "max_results", 0, 1, MAX_MAX_RESULTS)
+	if !ok {
+		return
+	}
+
+	withStats, ok := parseBoolParam(writer, query, "stats")
+	if !ok {
+		return
+	}
+
+	// The shards' stats are always asked for, for the log.
+	shardQuery := url.Values{"w": {keyword}, "stats": {"true"}}
+	if perBook > 0 {
+		// Each book is in exactly one shard, so the limit can be left to the shards.
+		shardQuery.Set("per_book", strconv.Itoa(perBook))
+	}
+	if maxResults > 0 {
+		// Each shard stops once it has found enough for the whole query.
+		shardQuery.Set("max_results", strconv.Itoa(maxResults))
+	}
+	if query.Has("finder") {
+		if !concordance.IsFinderName(query.Get("finder")) {
+			writeError(writer, "Unknown finder.")
+			return
+		}
+		shardQuery.Set("finder", query.Get("finder"))
+	}
+
+	ip, ok := checkRateLimit(config, writer, req, startTime)
+	if !ok {
+		return
+	}
+
+	// The shards time out their own queries, so the timeout only cuts off a shard that is stuck
+	// or overloaded. Cancelling the request cancels the shards' queries too.
+	ch := shard.Search(req.Context(), client, config.Shards, "/concord", shardQuery, config.ShardTimeout)
+
+	flusher := writer.(http.Flusher)
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	out := newMatchWriter(config, writer, flusher)
+	resultCount := 0
+	failed := 0
+	// the number of shards that are waiting for a slot
+	queued := 0
+	cached := 0
+	trailer := QueryTrailer{}
+	stats := concordance.QueryStats{}
+	// the number of matches from each shard, and the total number of hits in each, or -1 if it
+	// isn't known
+	shardMatches := make([]int, len(config.Shards))
+	shardTotals := make([]int, len(config.Shards))
+	// the shards that are sending a sample instead of their matches, which is left out, since
+	// it can't be merged with the other shards' matches into a uniform sample
+	sampled := make([]bool, len(config.Shards))
+	for i := range shardTotals {
+		shardTotals[i] = -1
+	}
+loop:
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				break loop
+			}
+
+			switch {
+			case event.Match != nil:
+				if sampled[event.Shard] {
+					continue
+				}
+				shardMatches[event.Shard] += 1
+				if maxResults > 0 && resultCount == maxResults {
+					trailer.Truncated = true
+					continue
+				}
+				resultCount += 1
+				out.writeLine(event.Match)
+			case event.Status == "queued":
+				queued += 1
+				if queued == 1 {
+					writeJsonLineIgnoreError(writer, flusher, ServerStatusMessage{Status: "queued"})
+				}
+			case event.Status == "ready":
+				queued -= 1
+				if queued == 0 {
+					writeJsonLineIgnoreError(writer, flusher, ServerStatusMessage{Status: "ready"})
+				}
+			case event.Warning != "":
+				message := fmt.Sprintf("Shard %d of %d: %s", event.Shard+1, len(config.Shards), event.Warning)
+				if event.Downgraded == EXPENSIVE_SAMPLE {
+					sampled[event.Shard] = true
+					message = fmt.Sprintf("Shard %d of %d has too many hits to send them all, so they are left out.", event.Shard+1, len(config.Shards))
+				}
+				writeJsonLineIgnoreError(writer, flusher, ServerWarningMessage{Warning: ServerWarning{Message: message}})
+			case event.Trailer != nil:
+				trailer.Partial = trailer.Partial || event.Trailer.Partial
+				trailer.Truncated = trailer.Truncated || event.Trailer.Truncated || sampled[event.Shard]
+				switch {
+				case sampled[event.Shard] || event.Trailer.Downgraded == EXPENSIVE_COUNT:
+					// The shard's hits were counted rather than sent, or left out above. A
+					// count cut short is only of the hits found so far.
+					if !event.Trailer.Partial {
+						shardTotals[event.Shard] = event.Trailer.Total
+					}
+				case !event.Trailer.Truncated:
+					shardTotals[event.Shard] = shardMatches[event.Shard]
+				case event.Trailer.Total > 0:
+					shardTotals[event.Shard] = event.Trailer.Total
+				}
+				if event.Trailer.Downgraded == EXPENSIVE_COUNT {
+					trailer.Downgraded = EXPENSIVE_COUNT
+				}
+				if event.Trailer.Cached {
+					cached += 1
+				}
+				if event.Trailer.Stats != nil {
+					stats.Add(*event.Trailer.Stats)
+				}
+				for fileName, n := range event.Trailer.Suppressed {
+					if trailer.Suppressed == nil {
+						trailer.Suppressed = make(map[string]int)
+					}
+					trailer.Suppressed[fileName] += n
+				}
+			case event.Err != nil:
+				failed += 1
+				trailer.Partial = true
+				log.Printf("shard failed: %s (%s)", config.Shards[event.Shard], event.Err)
+
+				message := fmt.Sprintf("Shard %d of %d failed, so some results are missing.", event.Shard+1, len(config.Shards))
+				if errors.Is(event.Err, context.DeadlineExceeded) {
+					message = fmt.Sprintf("Shard %d of %d did not answer in time, so some results are missing.", event.Shard+1, len(config.Shards))
+				}
+				writeJsonLineIgnoreError(writer, flusher, ServerWarningMessage{Warning: ServerWarning{Message: message}})
+			}
+		case <-out.deadline():
+			out.flush()
+		}
+	}
+
+	trailer.Cached = cached == len(config.Shards)
+	if (trailer.Truncated || trailer.Downgraded == EXPENSIVE_COUNT) && !slices.Contains(shardTotals, -1) {
+		for _, total := range shardTotals {
+			trailer.Total += total
+		}
+	}
+	if withStats {
+		trailer.Stats = &stats
+	}
+	writeJsonLineIgnoreError(writer, flusher, ServerTrailerMessage{Trailer: trailer})
+
+	note := fmt.Sprintf("from %d of %d shard(s)", len(config.Shards)-failed, len(config.Shards))
+	logQuery(keyword, resultCount, startTime, note, ip, &stats)
+}
+
+// handleCoordinatedManifest passes on the manifest of the first shard that answers. Every
+// shard has the manifest of the whole corpus.
+func handleCoordinatedManifest(config ServerConfig, client *http.Client, writer http.ResponseWriter, req *http.Request) {
+	for _, base := range config.Shards {
+		ctx, cancel := context.WithTimeout(req.Context(), config.ShardTimeout)
+		defer cancel()
+
+		shardReq, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/manifest", nil)
+		if err != nil {
+			continue
+		}
+		resp, err := client.Do(shardReq)
+		if err != nil {
+			log.Printf("failed to fetch manifest: %s (%s)", base, err)
+			continue
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Printf("failed to fetch manifest: %s (HTTP %d)", base, resp.StatusCode)
+			continue
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		io.Copy(writer, resp.Body)
+		return
+	}
+
+	writer.WriteHeader(http.StatusBadGateway)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleCoordinatedConcord(t *testing.T) {
+	maxResults := make(chan string, 2)
+	first := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		maxResults <- req.URL.Query().Get("max_results")
+		fmt.Fprintln(writer, `{"filename":"a","left":"the ","right":" swam"}`)
+		fmt.Fprintln(writer, `{"filename":"b","left":"a ","right":""}`)
+		fmt.Fprintln(writer, `{"trailer":{"partial":false,"truncated":false,"suppressed":{"a":1},"cached":true,"stats":{"pages_scanned":2,"bytes_scanned":100}}}`)
+	}))
+	defer first.Close()
+
+	second := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		maxResults <- req.URL.Query().Get("max_results")
+		fmt.Fprintln(writer, `{"status":"queued"}`)
+		fmt.Fprintln(writer, `{"status":"ready"}`)
+		fmt.Fprintln(writer, `{"filename":"c","left":"","right":""}`)
+		fmt.Fprintln(writer, `{"warning":{"message":"Only a sample is shown."}}`)
+		fmt.Fprintln(writer, `{"filename":"d","left":"","right":""}`)
+		fmt.Fprintln(writer, `{"trailer":{"partial":false,"truncated":true,"total":10,"suppressed":{"c":2},"cached":false,"stats":{"pages_scanned":3,"bytes_scanned":50}}}`)
+	}))
+	defer second.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	config := ServerConfig{Shards: []string{first.URL, second.URL}, ShardTimeout: time.Second, FlushBytes: 1024}
+	lines := coordinatedConcord(t, config, "/concord?w=whale&max_results=3&stats=true")
+	if <-maxResults != "3" || <-maxResults != "3" {
+		t.Fatal("expected max_results to be passed on to the shards")
+	}
+
+	matches, statuses, warnings, trailer := sortLines(t, lines)
+	if matches != 3 || len(statuses) != 2 || len(warnings) != 1 || warnings[0] != "Shard 2 of 2: Only a sample is shown." {
+		t.Fatalf("unexpected lines: %d match(es), statuses %v, warnings %v", matches, statuses, warnings)
+	}
+	if trailer == nil || trailer.Partial || !trailer.Truncated || trailer.Cached || trailer.Total != 12 {
+		t.Fatalf("unexpected trailer: %+v", trailer)
+	}
+	if trailer.Suppressed["a"] != 1 || trailer.Suppressed["c"] != 2 || trailer.Stats == nil || trailer.Stats.PagesScanned != 5 || trailer.Stats.BytesScanned != 150 {
+		t.Fatalf("unexpected trailer: %+v, stats %+v", trailer, trailer.Stats)
+	}
+
+	config.Shards = []string{first.URL, failing.URL}
+	lines = coordinatedConcord(t, config, "/concord?w=whale")
+	<-maxResults
+	matches, _, warnings, trailer = sortLines(t, lines)
+	if matches != 2 || len(warnings) != 1 || !strings.Contains(warnings[0], "Shard 2 of 2 failed") {
+		t.Fatalf("unexpected lines: %d match(es), warnings %v", matches, warnings)
+	}
+	// The total isn't known for a shard that failed.
+	if trailer == nil || !trailer.Partial || trailer.Truncated || trailer.Total != 0 || trailer.Stats != nil {
+		t.Fatalf("unexpected trailer: %+v", trailer)
+	}
+}
+
+func TestHandleCoordinatedConcordDowngraded(t *testing.T) {
+	first := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(writer, `{"filename":"a","left":"the ","right":" swam"}`)
+		fmt.Fprintln(writer, `{"filename":"b","left":"a ","right":""}`)
+		fmt.Fprintln(writer, `{"trailer":{"partial":false,"truncated":false,"cached":false}}`)
+	}))
+	defer first.Close()
+
+	counted := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(writer, `{"warning":{"message":"The keyword has 500 hits, too many to show them, so only the number of hits is given.","downgraded":"count"}}`)
+		fmt.Fprintln(writer, `{"trailer":{"partial":false,"truncated":false,"total":500,"downgraded":"count","cached":false}}`)
+	}))
+	defer counted.Close()
+
+	sampled := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(writer, `{"warning":{"message":"The keyword has about 5000 hits, too many to show them all, so only a random sample of 2 is shown.","downgraded":"sample"}}`)
+		fmt.Fprintln(writer, `{"filename":"c","left":"","right":""}`)
+		fmt.Fprintln(writer, `{"filename":"d","left":"","right":""}`)
+		fmt.Fprintln(writer, `{"trailer":{"partial":false,"truncated":false,"total":5000,"sampled":2,"downgraded":"sample","cached":false}}`)
+	}))
+	defer sampled.Close()
+
+	// The count is added to the number of matches that the other shard sent.
+	config := ServerConfig{Shards: []string{first.URL, counted.URL}, ShardTimeout: time.Second, FlushBytes: 1024}
+	matches, _, warnings, trailer := sortLines(t, coordinatedConcord(t, config, "/concord?w=whale"))
+	if matches != 2 || len(warnings) != 1 || !strings.HasPrefix(warnings[0], "Shard 2 of 2: The keyword has 500 hits") {
+		t.Fatalf("unexpected lines: %d match(es), warnings %v", matches, warnings)
+	}
+	if trailer == nil || trailer.Downgraded != EXPENSIVE_COUNT || trailer.Total != 502 || trailer.Truncated || trailer.Partial {
+		t.Fatalf("unexpected trailer: %+v", trailer)
+	}
+
+	// A shard's sample can't be merged with the other shard's matches, so it is left out.
+	config.Shards = []string{first.URL, sampled.URL}
+	matches, _, warnings, trailer = sortLines(t, coordinatedConcord(t, config, "/concord?w=whale"))
+	if matches != 2 || len(warnings) != 1 || !strings.Contains(warnings[0], "left out") {
+		t.Fatalf("unexpected lines: %d match(es), warnings %v", matches, warnings)
+	}
+	if trailer == nil || trailer.Downgraded != "" || !trailer.Truncated || trailer.Total != 5002 || trailer.Sampled != 0 {
+		t.Fatalf("unexpected trailer: %+v", trailer)
+	}
+}
+
+func coordinatedConcord(t *testing.T, config ServerConfig, target string) []string {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handleCoordinatedConcord(config, &http.Client{}, recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", recorder.Code)
+	}
+
+	lines := []string{}
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// sortLines returns the number of matches in a response, its statuses and warnings, and its
+// trailer, which must be the last line.
+func sortLines(t *testing.T, lines []string) (int, []string, []string, *QueryTrailer) {
+	t.Helper()
+
+	matches := 0
+	statuses := []string{}
+	warnings := []string{}
+	var trailer *QueryTrailer
+	for i, line := range lines {
+		var message struct {
+			Status   string        `json:"status"`
+			Warning  ServerWarning `json:"warning"`
+			Trailer  *QueryTrailer `json:"trailer"`
+			FileName string        `json:"filename"`
+		}
+		err := json.Unmarshal([]byte(line), &message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case message.FileName != "":
+			matches += 1
+		case message.Status != "":
+			statuses = append(statuses, message.Status)
+		case message.Warning.Message != "":
+			warnings = append(warnings, message.Warning.Message)
+		case message.Trailer != nil:
+			if i != len(lines)-1 {
+				t.Fatalf("trailer is not the last line: %v", lines)
+			}
+			trailer = message.Trailer
+		default:
+			t.Fatalf("unexpected line: %s", line)
+		}
+	}
+	return matches, statuses, warnings, trailer
+}
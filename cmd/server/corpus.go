@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/iafisher/fast-concordance/internal/concordance"
+)
+
+// Corpus is everything that queries are answered from. It is never modified: reloading the
+// server, or adding or removing a book, swaps in a new one.
+type Corpus struct {
+	Pages       concordance.Pages
+	Index       *concordance.Index
+	SuffixArray *concordance.SuffixArray
+	// incremented each time the corpus is replaced, so that results from different corpora
+	// aren't mixed up
+	Generation int
+	// one for each query using the corpus, plus one while it is the current corpus
+	refs sync.WaitGroup
+	// called once the corpus has been replaced and no query is using it any more: `Close`,
+	// unless the next corpus shares its memory
+	release func()
+	// closed after `release` has been called. A corpus may share memory with the one before
+	// it, so it isn't released until that one has been.
+	released         chan struct{}
+	previousReleased chan struct{}
+}
+
+// CorpusHolder holds the current corpus, and swaps in new ones without disturbing the
+// queries that are running on the old one.
+type CorpusHolder struct {
+	current *Corpus
+	mu      sync.Mutex
+	// held for the whole of a reload, so that only one runs at a time
+	reloadMu sync.Mutex
+}
+
+func NewCorpusHolder(corpus *Corpus) *CorpusHolder {
+	corpus.refs.Add(1)
+	corpus.released = make(chan struct{})
+	corpus.previousReleased = make(chan struct{})
+	close(corpus.previousReleased)
+	return &CorpusHolder{current: corpus}
+}
+
+// Acquire returns the current corpus, which stays usable until `release` is called.
+func (holder *CorpusHolder) Acquire() (corpus *Corpus, release func()) {
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+
+	corpus = holder.current
+	corpus.refs.Add(1)
+	return corpus, corpus.refs.Done
+}
+
+var ErrReloadInProgress = errors.New("a reload is already in progress")
+
+// Reload loads a new corpus and swaps it in. The old corpus is closed once the last query
+// using it has finished. If the new corpus can't be loaded, the old one stays in place.
+func (holder *CorpusHolder) Reload(config ServerConfig) (*Corpus, error) {
+	return holder.replace(config, func(old *Corpus) (*Corpus, error) {
+		corpus, err := LoadCorpus(config)
+		if err != nil {
+			return nil, err
+		}
+
+		old.release = old.Close
+		return corpus, nil
+	})
+}
+
+// Update swaps in a corpus with `update` applied to the current one, and saves its index so
+// that the next start-up doesn't rebuild the whole index. Like `Reload`, it leaves queries
+// that are running on the current corpus alone.
+func (holder *CorpusHolder) Update(config ServerConfig, update func(old *Corpus) (concordance.PagesUpdate, error)) (*Corpus, error) {
+	return holder.replace(config, func(old *Corpus) (*Corpus, error) {
+		if old.SuffixArray != nil {
+			return nil, errors.New("the suffix array can't be updated: rebuild it and reload")
+		}
+
+		result, err := update(old)
+		if err != nil {
+			return nil, err
+		}
+
+		// The index is saved while `reloadMu` is held, so that the saves of two updates can't
+		// overlap, and the one left on disk is always the latest.
+		if result.Index != nil {
+			err = result.Index.Save(config.IndexPath())
+			if err != nil {
+				log.Printf("failed to save index: %v", err)
+			}
+		}
+
+		old.release = result.Release
+		return &Corpus{Pages: result.Pages, Index: result.Index}, nil
+	})
+}
+
+// replace swaps in the corpus that `next` makes from the current one. `next` sets the old
+// corpus's `release`.
+func (holder *CorpusHolder) replace(config ServerConfig, next func(old *Corpus) (*Corpus, error)) (*Corpus, error) {
+	if !holder.reloadMu.TryLock() {
+		return nil, ErrReloadInProgress
+	}
+	defer holder.reloadMu.Unlock()
+
+	startTime := time.Now()
+	// Only `replace` changes `current`, so `old` stays current until the swap below.
+	old, release := holder.Acquire()
+	release()
+
+	corpus, err := next(old)
+	if err != nil {
+		return nil, err
+	}
+	corpus.Generation = old.Generation + 1
+	corpus.refs.Add(1)
+	corpus.released = make(chan struct{})
+	corpus.previousReleased = old.released
+
+	holder.mu.Lock()
+	holder.current = corpus
+	holder.mu.Unlock()
+
+	if config.ResultCache != nil {
+		config.ResultCache.Clear()
+	}
+
+	durationMs := time.Since(startTime).Milliseconds()
+	log.Printf("replaced corpus: %d page(s) (was %d) in %d ms", len(corpus.Pages.Pages), len(old.Pages.Pages), durationMs)
+
+	old.refs.Done()
+	go func() {
+		old.refs.Wait()
+		<-old.previousReleased
+		old.release()
+		close(old.released)
+		log.Printf("released corpus generation %d", old.Generation)
+	}()
+	return corpus, nil
+}
+
+// LoadCorpus loads the corpus that `config` describes, along with the index and suffix
+// array if it asks for them.
+func LoadCorpus(config ServerConfig) (*Corpus, error) {
+	// With a suffix array, the texts are read from the (memory-mapped) suffix array file
+	// rather than from the directory.
+	useSuffixArray := config.SuffixArrayPath != ""
+	// With a shard, the other shards' texts aren't read from the directory at all.
+	var keep func(fileName string) bool
+	if config.Shard != nil {
+		keep = config.Shard.Contains
+	}
+	var pages concordance.Pages
+	var err error
+	if config.PackedPath != "" {
+		pages, err = concordance.LoadPacked(config.PackedPath)
+		if err == nil && config.LimitTexts != -1 {
+			pages.Pages = pages.Pages[:min(config.LimitTexts, len(pages.Pages))]
+		}
+	} else if config.CompressedPath != "" {
+		pages, err = concordance.LoadCompressed(config.CompressedPath)
+		if err == nil && config.LimitTexts != -1 {
+			pages.Pages = pages.Pages[:min(config.LimitTexts, len(pages.Pages))]
+		}
+	} else if config.PageCache != nil {
+		// The texts may have changed since the last time the corpus was loaded.
+		config.PageCache.Clear()
+		pages, err = concordance.LoadPagesCached(config.Directory, config.LimitTexts, config.PageCache)
+	} else if config.UseMmap {
+		pages, err = concordance.LoadPagesWhere(config.Directory, useSuffixArray, config.LimitTexts, true, keep)
+	} else {
+		pages, err = concordance.LoadPagesWhere(config.Directory, useSuffixArray, config.LimitTexts, false, keep)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load pages: %w", err)
+	}
+
+	if config.Shard != nil {
+		// The packed and compressed corpora, and the page cache, still list the other shards'
+		// pages, but their texts are mapped or read lazily, so they are never read.
+		pages = concordance.SelectPages(pages, func(page concordance.Page) bool {
+			return config.Shard.Contains(page.FileName)
+		})
+	}
+
+	corpus := &Corpus{Pages: pages}
+	if useSuffixArray {
+		corpus.SuffixArray, err = concordance.LoadSuffixArray(config.SuffixArrayPath)
+		if err != nil {
+			corpus.Close()
+			return nil, fmt.Errorf("could not load suffix array: %w", err)
+		}
+		corpus.Pages.Pages = corpus.SuffixArray.Pages()
+	}
+
+	if len(corpus.Pages.Pages) == 0 {
+		corpus.Close()
+		return nil, errors.New("no texts were loaded")
+	}
+
+	if config.UseBloom {
+		concordance.BuildSignatures(corpus.Pages)
+	}
+
+	if config.UseIndex {
+		corpus.Index, err = concordance.LoadOrBuildIndexAt(config.IndexPath(), corpus.Pages)
+		if err != nil {
+			corpus.Close()
+			return nil, fmt.Errorf("could not load index: %w", err)
+		}
+	}
+
+	return corpus, nil
+}
+
+// Close releases the corpus's memory-mapped files.
+func (corpus *Corpus) Close() {
+	corpus.Pages.Close()
+	if corpus.SuffixArray != nil {
+		corpus.SuffixArray.Close()
+	}
+}
+
+// IndexPath returns where the index is kept. Each shard has an index of its own texts.
+func (config ServerConfig) IndexPath() string {
+	if config.Shard != nil {
+		return fmt.Sprintf("%s/%s.%d-of-%d", config.Directory, concordance.INDEX_FILE_NAME, config.Shard.Index, config.Shard.Count)
+	}
+	return fmt.Sprintf("%s/%s", config.Directory, concordance.INDEX_FILE_NAME)
+}
@@ -1,27 +1,59 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/iafisher/fast-concordance/internal/concordance"
+	"github.com/iafisher/fast-concordance/internal/querylane"
 	"github.com/iafisher/fast-concordance/internal/ratelimiter"
-	"golang.org/x/sync/semaphore"
+	"github.com/iafisher/fast-concordance/internal/resultcache"
+	"github.com/iafisher/fast-concordance/internal/shard"
 )
 
 const MIN_KEYWORD_LENGTH = 4
 const MAX_KEYWORD_LENGTH = 30
+const DEFAULT_KEYNESS_LIMIT = 50
+const MAX_KEYNESS_LIMIT = 500
+const DEFAULT_KEYNESS_MIN_COUNT = 5
+const MAX_KEYNESS_MIN_COUNT = 1000
+const DEFAULT_NGRAMS_LIMIT = 50
+const MAX_NGRAMS_LIMIT = 500
+const MAX_SAMPLE_SIZE = 10000
+const MAX_PER_BOOK = 10000
+const MAX_MAX_RESULTS = 100000
+
+// what to do with a query whose estimated number of hits is more than `-expensive-hits`;
+// under `EXPENSIVE_QUEUE`, it takes every slot in the main lane (see `chooseLanes`)
+const EXPENSIVE_ALLOW = "allow"
+const EXPENSIVE_QUEUE = "queue"
+const EXPENSIVE_SAMPLE = "sample"
+const EXPENSIVE_COUNT = "count"
+const EXPENSIVE_REJECT = "reject"
+
+// the size of the sample that expensive queries are answered with under `EXPENSIVE_SAMPLE`
+const EXPENSIVE_SAMPLE_SIZE = 1000
 
 func main() {
 	directory := flag.String("directory", "", "serve this directory of ebook files")
 	slow := flag.Bool("slow", false, "run the webserver in slow mode")
 	port := flag.Int("port", -1, "listen on this port")
-	maxConcurrent := flag.Int("max-concurrent", 4, "maximum requests to allow at once")
+	maxConcurrent := flag.Int("max-concurrent", 4, "maximum requests to allow at once, apart from those in the -cheap-slots lane (a concordance query takes more than one slot the more hits it is expected to have, up to all of them at -expensive-hits)")
 	limitTexts := flag.Int("limit-texts", -1, "load a subset of texts")
 	rateLimitRequests := flag.Int("rate-limit-requests", 10, "with -rate-limit-interval, maximum requests to allow in interval")
 	rateLimitInterval := flag.Duration("rate-limit-interval", time.Second*10, "with -rate-limit-requests, maximum requests to allow in interval")
@@ -31,19 +63,100 @@ func main() {
 	timeOutRead := flag.Duration("timeout-read", time.Second*10, "time-out for reading HTTP request")
 	timeOutWrite := flag.Duration("timeout-write", time.Minute, "time-out for writing HTTP response (all endpoints)")
 	timeOutIdle := flag.Duration("timeout-idle", 2*time.Minute, "time-out for idle connections")
+	suffixArray := flag.String("suffix-array", "", "load texts from this suffix array file (built by cmd/suffixarray) and use it for queries")
+	packed := flag.String("packed", "", "read the texts and manifest from this packed corpus file (built by cmd/pack) instead of -directory")
+	compressed := flag.String("compressed", "", "read the texts and manifest from this compressed corpus file (built by cmd/pack -compress) instead of -directory")
+	useMmap := flag.Bool("mmap", false, "memory-map the texts instead of reading them into memory (texts must then be replaced by writing a new file and renaming it, never rewritten in place)")
+	pageCacheMb := flag.Int("page-cache-mb", 0, "read the texts from disk when they are searched, keeping up to this many megabytes of them in memory (0 to read them all into memory at start-up)")
+	finder := flag.String("finder", concordance.FINDER_AUTO, fmt.Sprintf("default search algorithm for queries: %s, or %s to choose one per query", strings.Join(concordance.FinderNames(), ", "), concordance.FINDER_AUTO))
+	useBloom := flag.Bool("bloom", false, "build a Bloom filter of each text's trigrams at start-up, to skip texts that can't match")
+	useIndex := flag.Bool("index", false, "answer single-word queries from an inverted index (built on first run and saved next to manifest.json)")
+	adminToken := flag.String("admin-token", "", "enable the /admin/reload endpoint for requests with this bearer token")
+	cacheMb := flag.Int("cache-mb", 64, "megabytes of query results to keep in memory for repeated queries (0 to disable)")
+	flushInterval := flag.Duration("flush-interval", 50*time.Millisecond, "with -flush-kb, longest a result may wait to be sent to the client (0 to send each result at once)")
+	flushKb := flag.Int("flush-kb", 32, "with -flush-interval, send results to the client once this many kilobytes have built up")
+	shardFlag := flag.String("shard", "", "serve only this shard of the texts, written as index/count (e.g. 0/3), for a coordinator started with -shards")
+	shards := flag.String("shards", "", "run as a coordinator that answers /concord by querying these shard servers (comma-separated base URLs, e.g. http://localhost:8001,http://localhost:8002) instead of loading the texts itself")
+	shardTimeout := flag.Duration("shard-timeout", 2*time.Second, "with -shards, how long to wait for a shard to send anything (its response, or the next line of it) before answering without it")
+	expensiveHits := flag.Int("expensive-hits", 100000, "treat queries estimated to have more than this many hits (after max_results and per_book) as expensive")
+	expensiveQueries := flag.String("expensive-queries", EXPENSIVE_QUEUE, fmt.Sprintf("what to do with expensive queries: %s them to run like any other query (without estimating any query's cost), %s them to run alone, answer them with a %s of the hits or only a %s, or %s them", EXPENSIVE_ALLOW, EXPENSIVE_QUEUE, EXPENSIVE_SAMPLE, EXPENSIVE_COUNT, EXPENSIVE_REJECT))
+	cheapHits := flag.Int("cheap-hits", 1000, "treat queries estimated to have at most this many hits (after max_results and per_book) as cheap")
+	cheapSlots := flag.Int("cheap-slots", 2, "maximum cheap queries to allow at once in a lane of their own, so that they don't wait behind expensive ones (0 to share -max-concurrent with other queries)")
 	flag.Parse()
 
-	if *directory == "" {
+	if *directory == "" && *shards == "" {
 		fmt.Fprintln(os.Stderr, "-directory is required")
 		os.Exit(1)
 	}
 
+	var shardUrls []string
+	if *shards != "" {
+		if *directory != "" || *shardFlag != "" {
+			fmt.Fprintln(os.Stderr, "-shards can't be combined with -directory or -shard")
+			os.Exit(1)
+		}
+		for _, shardUrl := range strings.Split(*shards, ",") {
+			shardUrls = append(shardUrls, strings.TrimSuffix(shardUrl, "/"))
+		}
+	}
+
+	var serverShard *shard.Shard
+	if *shardFlag != "" {
+		if *suffixArray != "" {
+			fmt.Fprintln(os.Stderr, "-shard can't be combined with -suffix-array")
+			os.Exit(1)
+		}
+		parsed, err := shard.Parse(*shardFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		serverShard = &parsed
+	}
+
+	if !concordance.IsFinderName(*finder) {
+		fmt.Fprintf(os.Stderr, "unknown finder: %s\n", *finder)
+		os.Exit(1)
+	}
+
+	if (*finder == "index" && !*useIndex) || (*finder == "suffix-array" && *suffixArray == "") {
+		fmt.Fprintf(os.Stderr, "-finder %s requires -%s\n", *finder, *finder)
+		os.Exit(1)
+	}
+
+	if *pageCacheMb > 0 && (*useMmap || *packed != "" || *compressed != "" || *suffixArray != "") {
+		fmt.Fprintln(os.Stderr, "-page-cache-mb can't be combined with -mmap, -packed, -compressed or -suffix-array")
+		os.Exit(1)
+	}
+
+	if *compressed != "" && (*packed != "" || *suffixArray != "") {
+		fmt.Fprintln(os.Stderr, "-compressed can't be combined with -packed or -suffix-array")
+		os.Exit(1)
+	}
+
+	if !slices.Contains([]string{EXPENSIVE_ALLOW, EXPENSIVE_QUEUE, EXPENSIVE_SAMPLE, EXPENSIVE_COUNT, EXPENSIVE_REJECT}, *expensiveQueries) {
+		fmt.Fprintf(os.Stderr, "unknown -expensive-queries policy: %s\n", *expensiveQueries)
+		os.Exit(1)
+	}
+
 	if *port == -1 {
 		fmt.Fprintln(os.Stderr, "-port is required")
 		os.Exit(1)
 	}
 
 	rateLimiter := ratelimiter.NewRateLimiter(*rateLimitRequests, *rateLimitInterval, *rateLimitPenalty)
+	var resultCache *resultcache.ResultCache
+	if *cacheMb > 0 {
+		resultCache = resultcache.NewResultCache(int64(*cacheMb) * 1024 * 1024)
+	}
+	var pageCache *concordance.PageCache
+	if *pageCacheMb > 0 {
+		pageCache = concordance.NewPageCache(int64(*pageCacheMb) * 1024 * 1024)
+	}
+	var cheapLane *querylane.Lane
+	if *cheapSlots > 0 {
+		cheapLane = querylane.NewLane("cheap", *cheapSlots)
+	}
 	config := ServerConfig{
 		Directory:         *directory,
 		SlowMode:          *slow,
@@ -53,32 +166,41 @@ func main() {
 		TimeOutWrite:      *timeOutWrite,
 		TimeOutIdle:       *timeOutIdle,
 		Port:              *port,
-		Semaphore:         semaphore.NewWeighted(int64(*maxConcurrent)),
+		MainLane:          querylane.NewLane("main", *maxConcurrent),
+		CheapLane:         cheapLane,
 		RateLimiter:       &rateLimiter,
 		LimitTexts:        *limitTexts,
+		UseIndex:          *useIndex,
+		UseMmap:           *useMmap,
+		SuffixArrayPath:   *suffixArray,
+		PackedPath:        *packed,
+		CompressedPath:    *compressed,
+		Finder:            *finder,
+		UseBloom:          *useBloom,
+		ResultCache:       resultCache,
+		PageCache:         pageCache,
+		AdminToken:        *adminToken,
+		FlushInterval:     *flushInterval,
+		FlushBytes:        *flushKb * 1024,
+		Shard:             serverShard,
+		Shards:            shardUrls,
+		ShardTimeout:      *shardTimeout,
+		ExpensiveHits:     *expensiveHits,
+		ExpensivePolicy:   *expensiveQueries,
+		CheapHits:         *cheapHits,
 	}
 
 	webServer(config)
 }
 
 func webServer(config ServerConfig) {
-	pages, err := concordance.LoadPages(config.Directory, false, config.LimitTexts)
-	if err != nil {
-		log.Fatalf("could not load pages: %v", err)
+	var handler *http.ServeMux
+	if len(config.Shards) > 0 {
+		handler = coordinatorHandler(config)
+	} else {
+		handler = corpusHandler(config)
 	}
 
-	handler := &http.ServeMux{}
-
-	handler.HandleFunc("/concord", func(writer http.ResponseWriter, req *http.Request) {
-		handleConcord(config, pages, writer, req)
-	})
-	handler.HandleFunc("/", handleIndex)
-	handler.HandleFunc("/static/fast.js", handleJs)
-	handler.HandleFunc("/static/fast.css", handleCss)
-	handler.HandleFunc("/manifest", func(writer http.ResponseWriter, req *http.Request) {
-		handleManifest(pages, writer, req)
-	})
-
 	addr := fmt.Sprintf(":%d", config.Port)
 	server := &http.Server{
 		ReadHeaderTimeout: config.TimeOutReadHeader,
@@ -93,6 +215,65 @@ func webServer(config ServerConfig) {
 	log.Fatal("server failed", server.ListenAndServe())
 }
 
+// corpusHandler loads the corpus and returns the handler for a server that answers queries
+// from it.
+func corpusHandler(config ServerConfig) *http.ServeMux {
+	corpus, err := LoadCorpus(config)
+	if err != nil {
+		log.Fatalf("could not load corpus: %v", err)
+	}
+	holder := NewCorpusHolder(corpus)
+	reloadOnSignal(config, holder)
+
+	handler := &http.ServeMux{}
+
+	// Each request holds on to the corpus it started with, so that it isn't affected by a
+	// reload part of the way through.
+	handleWithCorpus := func(path string, handle func(corpus *Corpus, writer http.ResponseWriter, req *http.Request)) {
+		handler.HandleFunc(path, func(writer http.ResponseWriter, req *http.Request) {
+			corpus, release := holder.Acquire()
+			defer release()
+			handle(corpus, writer, req)
+		})
+	}
+
+	handleWithCorpus("/concord", func(corpus *Corpus, writer http.ResponseWriter, req *http.Request) {
+		handleConcord(config, corpus, writer, req)
+	})
+	handleWithCorpus("/timeline", func(corpus *Corpus, writer http.ResponseWriter, req *http.Request) {
+		handleTimeline(config, corpus.Pages, writer, req)
+	})
+	handleWithCorpus("/keyness", func(corpus *Corpus, writer http.ResponseWriter, req *http.Request) {
+		handleKeyness(config, corpus.Pages, writer, req)
+	})
+	handleWithCorpus("/ngrams", func(corpus *Corpus, writer http.ResponseWriter, req *http.Request) {
+		handleNgrams(config, corpus.Pages, writer, req)
+	})
+	if config.SuffixArrayPath != "" {
+		handleWithCorpus("/count", func(corpus *Corpus, writer http.ResponseWriter, req *http.Request) {
+			handleCount(config, corpus.SuffixArray, writer, req)
+		})
+	}
+	handler.HandleFunc("/stats", func(writer http.ResponseWriter, req *http.Request) {
+		handleStats(config, writer, req)
+	})
+	handler.HandleFunc("/", handleIndex)
+	handler.HandleFunc("/static/fast.js", handleJs)
+	handler.HandleFunc("/static/fast.css", handleCss)
+	handleWithCorpus("/manifest", func(corpus *Corpus, writer http.ResponseWriter, req *http.Request) {
+		handleManifest(corpus.Pages, writer, req)
+	})
+	if config.AdminToken != "" {
+		handler.HandleFunc("/admin/reload", func(writer http.ResponseWriter, req *http.Request) {
+			handleReload(config, holder, writer, req)
+		})
+		handler.HandleFunc("/admin/book", func(writer http.ResponseWriter, req *http.Request) {
+			handleBook(config, holder, writer, req)
+		})
+	}
+	return handler
+}
+
 type ServerConfig struct {
 	Directory         string
 	SlowMode          bool
@@ -103,8 +284,39 @@ type ServerConfig struct {
 	TimeOutIdle       time.Duration
 	Port              int
 	RateLimiter       *ratelimiter.IpRateLimiter
-	Semaphore         *semaphore.Weighted
-	LimitTexts        int
+	// the slots that queries hold while they run (see `chooseLanes`); `CheapLane` is nil if
+	// cheap queries share `MainLane`
+	MainLane        *querylane.Lane
+	CheapLane       *querylane.Lane
+	LimitTexts      int
+	UseIndex        bool
+	UseMmap         bool
+	SuffixArrayPath string
+	PackedPath      string
+	CompressedPath  string
+	Finder          string
+	UseBloom        bool
+	// nil if results aren't cached
+	ResultCache *resultcache.ResultCache
+	// nil unless the texts are read from disk when they are searched
+	PageCache *concordance.PageCache
+	// empty if the admin endpoints are disabled
+	AdminToken string
+	// how long a match may wait before the response is flushed, and how many bytes of
+	// matches are flushed at once (see `matchWriter`)
+	FlushInterval time.Duration
+	FlushBytes    int
+	// nil unless the server holds one shard of the corpus
+	Shard *shard.Shard
+	// for a coordinator, the base URLs of the shard servers
+	Shards       []string
+	ShardTimeout time.Duration
+	// queries estimated to have more than `ExpensiveHits` hits are handled according to
+	// `ExpensivePolicy` (one of the `EXPENSIVE_` constants), and those with at most
+	// `CheapHits` may run in `CheapLane`
+	ExpensiveHits   int
+	ExpensivePolicy string
+	CheapHits       int
 }
 
 func writeError(writer http.ResponseWriter, message string) {
@@ -113,10 +325,77 @@ func writeError(writer http.ResponseWriter, message string) {
 	writer.Write([]byte(s))
 }
 
+// ServerErrorMessage is the body of an error response that has more to say than
+// `writeError`, e.g. why a query was turned away.
+type ServerErrorMessage struct {
+	Error ServerError `json:"error"`
+}
+
+type ServerError struct {
+	Message string `json:"message"`
+	// for programs, e.g. "too_expensive"
+	Reason string `json:"reason,omitempty"`
+	// for "too_expensive", the estimated number of hits, and the most that the server allows
+	EstimatedHits int `json:"estimated_hits,omitempty"`
+	MaxHits       int `json:"max_hits,omitempty"`
+}
+
+func writeServerError(writer http.ResponseWriter, status int, serverError ServerError) {
+	jsonB, err := json.Marshal(ServerErrorMessage{Error: serverError})
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(jsonB)
+}
+
+func writeJson(writer http.ResponseWriter, v any) {
+	jsonB, err := json.Marshal(v)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsonB)
+}
+
 type ServerStatusMessage struct {
 	Status string `json:"status"`
 }
 
+// ServerTrailerMessage is written after the last match, for queries that have something to
+// report about the result set as a whole.
+type ServerTrailerMessage struct {
+	Trailer QueryTrailer `json:"trailer"`
+}
+
+type QueryTrailer struct {
+	// true if the query timed out before the whole corpus was searched
+	Partial bool `json:"partial"`
+	// true if there were more hits than `max_results`, and the rest were left out
+	Truncated bool `json:"truncated"`
+	// for `sample` queries, the number of hits the sample was drawn from; for truncated
+	// queries, the number of hits there were, if it is known without finding them all; for
+	// queries downgraded to a count, the number of hits
+	Total   int    `json:"total,omitempty"`
+	Sampled int    `json:"sampled,omitempty"`
+	Seed    uint64 `json:"seed,omitempty"`
+	// for expensive queries that were answered with a sample or a count instead of every hit
+	// (see `-expensive-queries`), `EXPENSIVE_SAMPLE` or `EXPENSIVE_COUNT`
+	Downgraded string `json:"downgraded,omitempty"`
+	// for `per_book` queries, at least how many hits were left out of each book that hit the
+	// limit (the search stops looking in a book once it is over the limit)
+	Suppressed map[string]int `json:"suppressed,omitempty"`
+	// true if the results were replayed from the result cache rather than searched for
+	Cached bool `json:"cached"`
+	// for queries with `stats=true` that were searched for, what the search cost
+	Stats *concordance.QueryStats `json:"stats,omitempty"`
+}
+
 func writeJsonLineIgnoreError(writer http.ResponseWriter, flusher http.Flusher, v any) {
 	jsonB, err := json.Marshal(v)
 	if err != nil {
@@ -128,92 +407,753 @@ func writeJsonLineIgnoreError(writer http.ResponseWriter, flusher http.Flusher,
 	flusher.Flush()
 }
 
-func handleConcord(config ServerConfig, pages concordance.Pages, writer http.ResponseWriter, req *http.Request) {
+func handleConcord(config ServerConfig, corpus *Corpus, writer http.ResponseWriter, req *http.Request) {
 	startTime := time.Now()
 	query := req.URL.Query()
 	keyword := query.Get("w")
 
-	if len(keyword) < MIN_KEYWORD_LENGTH {
-		writeError(writer, fmt.Sprintf("The keyword must be at least %d letters long.", MIN_KEYWORD_LENGTH))
+	if !checkKeyword(writer, keyword) {
 		return
 	}
 
-	if len(keyword) > MAX_KEYWORD_LENGTH {
-		writeError(writer, fmt.Sprintf("The keyword cannot be longer than %d letters.", MAX_KEYWORD_LENGTH))
+	sampleSize, ok := parseIntParam(writer, query, "sample", 0, 1, MAX_SAMPLE_SIZE)
+	if !ok {
 		return
 	}
 
-	ipList, ok := req.Header["X-Real-Ip"]
+	perBook, ok := parseIntParam(writer, query, "per_book", 0, 1, MAX_PER_BOOK)
+	if !ok {
+		return
+	}
 
-	ip := "unknown"
-	if ok && len(ipList) > 0 {
-		ip = ipList[0]
-		if !config.RateLimiter.IsOk(ip, startTime) {
-			writer.WriteHeader(http.StatusTooManyRequests)
+	maxResults, ok := parseIntParam(writer, query, "max_results", 0, 1, MAX_MAX_RESULTS)
+	if !ok {
+		return
+	}
+
+	withStats, ok := parseBoolParam(writer, query, "stats")
+	if !ok {
+		return
+	}
+
+	finder := config.Finder
+	if query.Has("finder") {
+		finder = query.Get("finder")
+		if !concordance.IsFinderName(finder) {
+			writeError(writer, "Unknown finder.")
 			return
 		}
 	}
 
-	flusher := writer.(http.Flusher)
-	acquired := config.Semaphore.TryAcquire(1)
-	if !acquired {
-		writeJsonLineIgnoreError(writer, flusher, ServerStatusMessage{Status: "queued"})
-		// `req.Context()` ensures that we no longer try to acquire if the request is cancelled.
-		err := config.Semaphore.Acquire(req.Context(), 1)
+	seed := rand.Uint64()
+	if query.Has("seed") {
+		var err error
+		seed, err = strconv.ParseUint(query.Get("seed"), 10, 64)
 		if err != nil {
-			writer.WriteHeader(http.StatusInternalServerError)
+			writeError(writer, "The seed parameter must be a non-negative integer.")
 			return
 		}
-		defer config.Semaphore.Release(1)
+	}
 
-		writeJsonLineIgnoreError(writer, flusher, ServerStatusMessage{Status: "ready"})
-	} else {
-		defer config.Semaphore.Release(1)
+	ip, ok := checkRateLimit(config, writer, req, startTime)
+	if !ok {
+		return
 	}
 
-	quitChannel := make(chan struct{})
-	go func() {
-		select {
-		case <-req.Context().Done():
-		case <-time.After(config.TimeOutQuery):
+	flusher := writer.(http.Flusher)
+	// A complete result set answers the query whatever its `max_results`; otherwise a result
+	// set truncated at the same `max_results` will do.
+	cacheKey := resultcache.Key(corpus.Generation, keyword, perBook, 0)
+	truncatedCacheKey := resultcache.Key(corpus.Generation, keyword, perBook, maxResults)
+	if sampleSize == 0 && config.ResultCache != nil {
+		// Cache hits don't need a slot: replaying them is no more work than any other response.
+		entry, ok := config.ResultCache.Get(cacheKey)
+		if !ok && maxResults > 0 {
+			entry, ok = config.ResultCache.Get(truncatedCacheKey)
 		}
-		close(quitChannel)
-	}()
+		if ok {
+			writer.Header().Set("Content-Type", "application/x-ndjson")
+			out := newMatchWriter(config, writer, flusher)
+			matches := entry.Matches
+			trailer := QueryTrailer{Suppressed: entry.Suppressed, Cached: true, Truncated: entry.Truncated, Total: entry.Total}
+			if maxResults > 0 && len(matches) > maxResults {
+				matches = matches[:maxResults]
+				trailer.Truncated = true
+				trailer.Total = len(entry.Matches)
+			}
+			for _, match := range matches {
+				out.write(match)
+			}
+			writeJsonLineIgnoreError(writer, flusher, ServerTrailerMessage{Trailer: trailer})
+			logQuery(keyword, len(matches), startTime, "cached", ip, nil)
+			return
+		}
+	}
 
-	ch, err := concordance.StreamSearch(pages, keyword, quitChannel, 0)
-	if err != nil {
+	options := concordance.SearchOptions{PerPageLimit: perBook, Finder: finder, Index: corpus.Index, SuffixArray: corpus.SuffixArray}
+	// Queries whose cost isn't known, and samples, take one slot in the main lane.
+	lanes := []*querylane.Lane{config.MainLane}
+	weight := int64(1)
+	// "" unless the query is expensive and is answered with a sample or a count instead
+	downgraded := ""
+	var estimate concordance.HitEstimate
+	if sampleSize == 0 && config.ExpensivePolicy != EXPENSIVE_ALLOW {
+		var cost int
+		estimate, cost, ok = estimateCost(corpus, keyword, options, maxResults)
+		if ok && cost > config.ExpensiveHits && config.ExpensivePolicy != EXPENSIVE_QUEUE {
+			switch config.ExpensivePolicy {
+			case EXPENSIVE_SAMPLE:
+				sampleSize = EXPENSIVE_SAMPLE_SIZE
+				downgraded = EXPENSIVE_SAMPLE
+			case EXPENSIVE_COUNT:
+				downgraded = EXPENSIVE_COUNT
+			case EXPENSIVE_REJECT:
+				writeServerError(writer, http.StatusBadRequest, ServerError{
+					Message:       fmt.Sprintf("The keyword has %s hits, more than this server searches for at once (%d). Try a less common keyword, or ask for fewer results.", describeEstimate(estimate), config.ExpensiveHits),
+					Reason:        "too_expensive",
+					EstimatedHits: estimate.Hits,
+					MaxHits:       config.ExpensiveHits,
+				})
+				logQuery(keyword, 0, startTime, fmt.Sprintf("rejected: %s hit(s)", describeEstimate(estimate)), ip, nil)
+				return
+			}
+		} else if ok {
+			lanes, weight = chooseLanes(config, cost)
+		}
+	}
+
+	release, ok := acquireSlots(writer, flusher, req, lanes, weight)
+	if !ok {
+		return
+	}
+	defer release()
+
+	quitChannel, stop := makeStoppableQuitChannel(config, req)
+	if downgraded != "" {
+		writer.Header().Set("Content-Type", "application/x-ndjson")
+		message := fmt.Sprintf("The keyword has %s hits, too many to show them all, so only a random sample of %d is shown.", describeEstimate(estimate), sampleSize)
+		if downgraded == EXPENSIVE_COUNT {
+			message = fmt.Sprintf("The keyword has %s hits, too many to show them, so only the number of hits is given.", describeEstimate(estimate))
+		}
+		writeJsonLineIgnoreError(writer, flusher, ServerWarningMessage{Warning: ServerWarning{Message: message, Downgraded: downgraded}})
+	}
+
+	if downgraded == EXPENSIVE_COUNT {
+		total, partial := estimate.Hits, false
+		if !estimate.Exact() {
+			total, partial = concordance.CountMatches(corpus.Pages, keyword, perBook, quitChannel, 0)
+		}
+		trailer := QueryTrailer{Partial: partial, Total: total, Downgraded: downgraded}
+		writeJsonLineIgnoreError(writer, flusher, ServerTrailerMessage{Trailer: trailer})
+		logQuery(keyword, 0, startTime, fmt.Sprintf("counted %d hit(s) instead", total), ip, nil)
+		return
+	}
+
+	if sampleSize > 0 {
+		writeSample(config, corpus.Pages, keyword, sampleSize, seed, downgraded, quitChannel, writer, flusher)
+		durationMs := time.Since(startTime).Milliseconds()
+		note := ""
+		if downgraded != "" {
+			note = fmt.Sprintf("instead of %s hit(s); ", describeEstimate(estimate))
+		}
+		log.Printf("sample of %d for '%v' in %d ms (%sip: %s)", sampleSize, keyword, durationMs, note, ip)
+		return
+	}
+
+	ch, stats, err := concordance.StreamSearch(corpus.Pages, keyword, quitChannel, options)
+	if errors.Is(err, concordance.ErrFinderUnavailable) {
+		writeError(writer, fmt.Sprintf("The %s finder cannot answer this query.", finder))
+		return
+	} else if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	writer.Header().Set("Content-Type", "application/x-ndjson")
+	out := newMatchWriter(config, writer, flusher)
 	resultCount := 0
 	quitEarly := false
-	for match := range ch {
-		resultCount += 1
-		writeJsonLineIgnoreError(writer, flusher, match)
+	truncated := false
+	// The matches are collected for the cache until there are too many of them to fit in it.
+	collecting := config.ResultCache != nil
+	var matches []concordance.Match
+	var matchesSize int64
+loop:
+	for {
+		select {
+		case batch, ok := <-ch:
+			if !ok {
+				break loop
+			}
+
+			if maxResults > 0 && resultCount+len(batch) > maxResults {
+				batch = batch[:maxResults-resultCount]
+				truncated = true
+			}
+			resultCount += len(batch)
+			for _, match := range batch {
+				out.write(match)
+			}
+			if collecting {
+				matches = append(matches, batch...)
+				for _, match := range batch {
+					matchesSize += resultcache.MatchSize(match)
+				}
+				if matchesSize > config.ResultCache.MaxBytes {
+					collecting = false
+					matches = nil
+				}
+			}
+
+			if truncated {
+				// Stop the workers now, rather than letting them fill the channel with matches
+				// that won't be sent.
+				stop()
+				break loop
+			}
 
-		if config.SlowMode {
-			time.Sleep(100 * time.Millisecond)
+			if isClosed(quitChannel) {
+				quitEarly = true
+				break loop
+			}
+		case <-out.deadline():
+			out.flush()
 		}
+	}
 
-		select {
-		case <-quitChannel:
-			quitEarly = true
-		default:
-			continue
+	if quitEarly || truncated {
+		// `stats` isn't complete until the workers have exited.
+		for range ch {
+		}
+	}
+
+	summary := stats.Summary()
+	trailer := QueryTrailer{Partial: quitEarly, Truncated: truncated, Suppressed: stats.Suppressed}
+	if truncated && corpus.Index != nil && concordance.IsIndexable(keyword) {
+		trailer.Total = corpus.Index.CountHits(keyword, perBook)
+	}
+	if withStats {
+		trailer.Stats = &summary
+	}
+	writeJsonLineIgnoreError(writer, flusher, ServerTrailerMessage{Trailer: trailer})
+
+	// Partial results aren't cached, since the next query for the keyword may get further.
+	// The workers may have given up after the last match, so `quitEarly` isn't enough, except
+	// for truncated results, whose workers were stopped once there were enough matches.
+	// Results too big for the cache weren't collected.
+	if collecting && truncated && !quitEarly {
+		config.ResultCache.Put(truncatedCacheKey, resultcache.Entry{Matches: matches, Suppressed: stats.Suppressed, Truncated: true, Total: trailer.Total})
+	} else if collecting && !truncated && !isClosed(quitChannel) {
+		config.ResultCache.Put(cacheKey, resultcache.Entry{Matches: matches, Suppressed: stats.Suppressed})
+	}
+
+	note := ""
+	if quitEarly {
+		note = "timed out/cancelled"
+	} else if truncated {
+		note = "truncated"
+	}
+	logQuery(keyword, resultCount, startTime, note, ip, &summary)
+}
+
+// logQuery logs a concordance query, with what it cost if `stats` isn't nil.
+func logQuery(keyword string, resultCount int, startTime time.Time, note string, ip string, stats *concordance.QueryStats) {
+	durationMs := time.Since(startTime).Milliseconds()
+	if note != "" {
+		note += "; "
+	}
+	line := fmt.Sprintf("%d result(s) for '%v' in %d ms (%sip: %s)", resultCount, keyword, durationMs, note, ip)
+	if stats != nil {
+		line += ": " + stats.String()
+	}
+	log.Print(line)
+}
+
+// estimateCost estimates the number of hits for a query, and returns the number that would
+// be sent, or false if the hits can't be estimated.
+func estimateCost(corpus *Corpus, keyword string, options concordance.SearchOptions, maxResults int) (concordance.HitEstimate, int, bool) {
+	estimate, ok := concordance.EstimateHits(corpus.Pages, keyword, options)
+	if !ok {
+		return estimate, 0, false
+	}
+
+	cost := estimate.Hits
+	if maxResults > 0 {
+		cost = min(cost, maxResults)
+	}
+	return estimate, cost, true
+}
+
+// describeEstimate returns e.g. "about 1000", or just "1000" if the estimate is exact.
+func describeEstimate(estimate concordance.HitEstimate) string {
+	if estimate.Exact() {
+		return strconv.Itoa(estimate.Hits)
+	}
+	return fmt.Sprintf("about %d", estimate.Hits)
+}
+
+// chooseLanes returns the lanes that a query expected to send `cost` hits may run in, in
+// order of preference, and how many slots it takes. A cheap query takes one slot, in the
+// cheap lane if there is one, so that it never waits behind an expensive query (though it may
+// use a free slot in the main lane). Other queries take slots in the main lane in proportion
+// to their cost, up to the whole lane for one that costs `config.ExpensiveHits`, which then
+// runs alone.
+//
+// The text that a query scans isn't counted: every query that the index or the suffix array
+// can't answer scans the whole corpus, so the hits are what set queries apart.
+func chooseLanes(config ServerConfig, cost int) ([]*querylane.Lane, int64) {
+	if cost <= config.CheapHits {
+		if config.CheapLane != nil {
+			return []*querylane.Lane{config.CheapLane, config.MainLane}, 1
+		}
+		return []*querylane.Lane{config.MainLane}, 1
+	}
+
+	size := config.MainLane.Size()
+	weight := 1 + int64(cost)*(size-1)/int64(max(config.ExpensiveHits, 1))
+	return []*querylane.Lane{config.MainLane}, min(weight, size)
+}
+
+// acquireSlots takes `weight` slots in the first of `lanes` that has them free, or else waits
+// for them in the first lane, writing a "queued" status line while it waits and a "ready"
+// line once it has them. It returns a function that releases them, or false if the request
+// was cancelled while it waited.
+func acquireSlots(writer http.ResponseWriter, flusher http.Flusher, req *http.Request, lanes []*querylane.Lane, weight int64) (func(), bool) {
+	for _, lane := range lanes {
+		if lane.TryAcquire(weight) {
+			return func() { lane.Release(weight) }, true
+		}
+	}
+
+	lane := lanes[0]
+	writeJsonLineIgnoreError(writer, flusher, ServerStatusMessage{Status: "queued"})
+	// `req.Context()` ensures that we no longer try to acquire if the request is cancelled.
+	_, err := lane.Acquire(req.Context(), weight)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	writeJsonLineIgnoreError(writer, flusher, ServerStatusMessage{Status: "ready"})
+	return func() { lane.Release(weight) }, true
+}
+
+// writeSample answers a query with a sample of its hits. `downgraded` is passed on to the
+// trailer (see `QueryTrailer.Downgraded`).
+func writeSample(config ServerConfig, pages concordance.Pages, keyword string, size int, seed uint64, downgraded string, quitChannel chan struct{}, writer http.ResponseWriter, flusher http.Flusher) {
+	sample, err := concordance.SampleSearch(pages, keyword, size, seed, quitChannel, 0)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	// The whole sample is ready at once, so the trailer's flush sends whatever is left of it.
+	out := newMatchWriter(config, writer, flusher)
+	for _, match := range sample.Matches {
+		out.write(match)
+	}
+
+	trailer := QueryTrailer{Partial: sample.Partial, Total: sample.Total, Sampled: len(sample.Matches), Seed: seed, Downgraded: downgraded}
+	writeJsonLineIgnoreError(writer, flusher, ServerTrailerMessage{Trailer: trailer})
+}
+
+func handleTimeline(config ServerConfig, pages concordance.Pages, writer http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	keyword := req.URL.Query().Get("w")
+
+	if !checkKeyword(writer, keyword) {
+		return
+	}
+
+	ip, ok := checkRateLimit(config, writer, req, startTime)
+	if !ok {
+		return
+	}
+
+	_, err := config.MainLane.Acquire(req.Context(), 1)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer config.MainLane.Release(1)
+
+	quitChannel := makeQuitChannel(config, req)
+	timeline, err := concordance.BuildTimeline(pages, keyword, quitChannel)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(writer, timeline)
+
+	durationMs := time.Since(startTime).Milliseconds()
+	log.Printf("timeline for '%v' in %d ms (partial: %v; ip: %s)", keyword, durationMs, timeline.Partial, ip)
+}
+
+func handleKeyness(config ServerConfig, pages concordance.Pages, writer http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	query := req.URL.Query()
+
+	filterA := concordance.PageFilter{Authors: query["a_author"], Files: query["a_file"]}
+	filterB := concordance.PageFilter{Authors: query["b_author"], Files: query["b_file"]}
+	if filterA.IsEmpty() {
+		writeError(writer, "At least one of a_author or a_file is required.")
+		return
+	}
+
+	limit, ok := parseIntParam(writer, query, "limit", DEFAULT_KEYNESS_LIMIT, 1, MAX_KEYNESS_LIMIT)
+	if !ok {
+		return
+	}
+
+	minCount, ok := parseIntParam(writer, query, "min_count", DEFAULT_KEYNESS_MIN_COUNT, 1, MAX_KEYNESS_MIN_COUNT)
+	if !ok {
+		return
+	}
+
+	pagesA, rest := concordance.FilterPages(pages, filterA)
+	pagesB := rest
+	if !filterB.IsEmpty() {
+		pagesB, _ = concordance.FilterPages(rest, filterB)
+	}
+
+	if len(pagesA.Pages) == 0 || len(pagesB.Pages) == 0 {
+		writeError(writer, "No books matched the filters.")
+		return
+	}
+
+	ip, ok := checkRateLimit(config, writer, req, startTime)
+	if !ok {
+		return
+	}
+
+	_, err := config.MainLane.Acquire(req.Context(), 1)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer config.MainLane.Release(1)
+
+	quitChannel := makeQuitChannel(config, req)
+	options := concordance.KeynessOptions{Limit: limit, MinCount: minCount}
+	keyness := concordance.CompareKeyness(pagesA, pagesB, options, quitChannel)
+	writeJson(writer, keyness)
+
+	durationMs := time.Since(startTime).Milliseconds()
+	log.Printf("keyness for %d vs. %d book(s) in %d ms (partial: %v; ip: %s)", keyness.BooksA, keyness.BooksB, durationMs, keyness.Partial, ip)
+}
+
+func handleNgrams(config ServerConfig, pages concordance.Pages, writer http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	query := req.URL.Query()
+	keyword := query.Get("w")
+
+	if !checkKeyword(writer, keyword) {
+		return
+	}
+
+	n, ok := parseIntParam(writer, query, "n", 3, concordance.MIN_NGRAM_LENGTH, concordance.MAX_NGRAM_LENGTH)
+	if !ok {
+		return
+	}
+
+	limit, ok := parseIntParam(writer, query, "limit", DEFAULT_NGRAMS_LIMIT, 1, MAX_NGRAMS_LIMIT)
+	if !ok {
+		return
+	}
+
+	position := concordance.NGRAM_START
+	if query.Has("position") {
+		var err error
+		position, err = concordance.ParseNgramPosition(query.Get("position"))
+		if err != nil {
+			writeError(writer, "The position parameter must be 'start' or 'end'.")
+			return
+		}
+	}
+
+	ip, ok := checkRateLimit(config, writer, req, startTime)
+	if !ok {
+		return
+	}
+
+	_, err := config.MainLane.Acquire(req.Context(), 1)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer config.MainLane.Release(1)
+
+	quitChannel := makeQuitChannel(config, req)
+	ngrams, err := concordance.CountNgrams(pages, keyword, n, position, limit, quitChannel)
+	if errors.Is(err, concordance.ErrNgramLength) {
+		writeError(writer, "The n-gram must be longer than the keyword.")
+		return
+	} else if err != nil {
+		log.Printf("failed to count n-grams: %s (%s)", keyword, err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(writer, ngrams)
+
+	durationMs := time.Since(startTime).Milliseconds()
+	log.Printf("%d-grams for '%v' in %d ms (partial: %v; ip: %s)", n, keyword, durationMs, ngrams.Partial, ip)
+}
+
+// reloadOnSignal reloads the corpus in the background whenever the server receives SIGHUP.
+func reloadOnSignal(config ServerConfig, holder *CorpusHolder) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Printf("received SIGHUP: reloading corpus")
+			_, err := holder.Reload(config)
+			if err != nil {
+				log.Printf("failed to reload corpus: %v", err)
+			}
 		}
+	}()
+}
+
+type ReloadResult struct {
+	Pages      int   `json:"pages"`
+	Generation int   `json:"generation"`
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// handleReload reloads the corpus, and responds once the new one is in place.
+func handleReload(config ServerConfig, holder *CorpusHolder, writer http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	if req.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !checkAdminToken(config, writer, req) {
+		return
+	}
+
+	corpus, err := holder.Reload(config)
+	if errors.Is(err, ErrReloadInProgress) {
+		writeError(writer, "A reload is already in progress.")
+		return
+	} else if err != nil {
+		log.Printf("failed to reload corpus: %v", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	durationMs := time.Since(startTime).Milliseconds()
+	writeJson(writer, ReloadResult{Pages: len(corpus.Pages.Pages), Generation: corpus.Generation, DurationMs: durationMs})
+}
+
+// handleBook adds or replaces (PUT) or removes (DELETE) the book named by the `name`
+// parameter, which is a directory in `config.Directory` with an entry in its manifest.
+//
+// With -mmap, a book's text must be replaced by writing a new file and renaming it over the
+// old one, since queries may still be reading the old file's mapping.
+func handleBook(config ServerConfig, holder *CorpusHolder, writer http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	if req.Method != http.MethodPut && req.Method != http.MethodDelete {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !checkAdminToken(config, writer, req) {
+		return
+	}
 
-		if quitEarly {
-			break
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		writeError(writer, "The name parameter is required.")
+		return
+	}
+
+	if config.Shard != nil && req.Method == http.MethodPut && !config.Shard.Contains(name) {
+		writeError(writer, "The book belongs to another shard.")
+		return
+	}
+
+	corpus, err := holder.Update(config, func(old *Corpus) (concordance.PagesUpdate, error) {
+		if req.Method == http.MethodPut {
+			return concordance.AddPage(old.Pages, old.Index, config.Directory, name, config.UseMmap)
+		} else {
+			return concordance.RemovePage(old.Pages, old.Index, name)
 		}
+	})
+	if errors.Is(err, ErrReloadInProgress) {
+		writeError(writer, "A reload is already in progress.")
+		return
+	} else if errors.Is(err, concordance.ErrNoSuchPage) {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("failed to update book %s: %v", name, err)
+		writeError(writer, "The book could not be updated. See the server log for details.")
+		return
 	}
 
 	durationMs := time.Since(startTime).Milliseconds()
-	if quitEarly {
-		log.Printf("%d result(s) for '%v' in %d ms (timed out/cancelled; ip: %s)", resultCount, keyword, durationMs, ip)
-	} else {
-		log.Printf("%d result(s) for '%v' in %d ms (ip: %s)", resultCount, keyword, durationMs, ip)
+	writeJson(writer, ReloadResult{Pages: len(corpus.Pages.Pages), Generation: corpus.Generation, DurationMs: durationMs})
+}
+
+// checkAdminToken writes an error response and returns false if the request doesn't have
+// the admin token.
+func checkAdminToken(config ServerConfig, writer http.ResponseWriter, req *http.Request) bool {
+	token := []byte(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	if subtle.ConstantTimeCompare(token, []byte(config.AdminToken)) != 1 {
+		writer.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+type ServerStats struct {
+	// nil without -page-cache-mb
+	PageCache *concordance.PageCacheStats `json:"page_cache,omitempty"`
+	// how busy each lane is, and how long queries have waited for it
+	Lanes []querylane.LaneStats `json:"lanes"`
+}
+
+// handleStats reports the server's cache and queueing statistics.
+func handleStats(config ServerConfig, writer http.ResponseWriter, req *http.Request) {
+	stats := ServerStats{Lanes: []querylane.LaneStats{config.MainLane.Stats()}}
+	if config.CheapLane != nil {
+		stats.Lanes = append(stats.Lanes, config.CheapLane.Stats())
+	}
+	if config.PageCache != nil {
+		pageCacheStats := config.PageCache.Stats()
+		stats.PageCache = &pageCacheStats
+	}
+	writeJson(writer, stats)
+}
+
+type CountResult struct {
+	Count int `json:"count"`
+}
+
+// handleCount returns the number of times the keyword occurs in the corpus as a substring,
+// including in the middle of words.
+func handleCount(config ServerConfig, suffixArray *concordance.SuffixArray, writer http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	keyword := req.URL.Query().Get("w")
+
+	if !checkKeyword(writer, keyword) {
+		return
+	}
+
+	_, ok := checkRateLimit(config, writer, req, startTime)
+	if !ok {
+		return
+	}
+
+	// no need for a slot: this is a couple of binary searches
+	writeJson(writer, CountResult{Count: suffixArray.Count(keyword)})
+}
+
+// parseIntParam writes an error response and returns false if the query parameter is
+// present but is not an integer in [minValue, maxValue].
+func parseIntParam(writer http.ResponseWriter, query url.Values, name string, defaultValue int, minValue int, maxValue int) (int, bool) {
+	s := query.Get(name)
+	if s == "" {
+		return defaultValue, true
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < minValue || n > maxValue {
+		writeError(writer, fmt.Sprintf("The %s parameter must be an integer between %d and %d.", name, minValue, maxValue))
+		return 0, false
+	}
+	return n, true
+}
+
+func parseBoolParam(writer http.ResponseWriter, query url.Values, name string) (bool, bool) {
+	s := query.Get(name)
+	if s == "" {
+		return false, true
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		writeError(writer, fmt.Sprintf("The %s parameter must be true or false.", name))
+		return false, false
+	}
+	return b, true
+}
+
+// checkKeyword writes an error response and returns false if `keyword` is not valid.
+func checkKeyword(writer http.ResponseWriter, keyword string) bool {
+	if len(keyword) < MIN_KEYWORD_LENGTH {
+		writeError(writer, fmt.Sprintf("The keyword must be at least %d letters long.", MIN_KEYWORD_LENGTH))
+		return false
+	}
+
+	if len(keyword) > MAX_KEYWORD_LENGTH {
+		writeError(writer, fmt.Sprintf("The keyword cannot be longer than %d letters.", MAX_KEYWORD_LENGTH))
+		return false
+	}
+
+	for i := 0; i < len(keyword); i++ {
+		if keyword[i] < ' ' || keyword[i] == 0x7f {
+			writeError(writer, "The keyword cannot contain control characters.")
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkRateLimit returns the client's IP, and false (after writing an error response) if
+// the client has been rate-limited.
+func checkRateLimit(config ServerConfig, writer http.ResponseWriter, req *http.Request, now time.Time) (string, bool) {
+	ipList, ok := req.Header["X-Real-Ip"]
+
+	ip := "unknown"
+	if ok && len(ipList) > 0 {
+		ip = ipList[0]
+		if !config.RateLimiter.IsOk(ip, now) {
+			writer.WriteHeader(http.StatusTooManyRequests)
+			return ip, false
+		}
+	}
+
+	return ip, true
+}
+
+// makeQuitChannel returns a channel that is closed when the request is cancelled or the
+// query times out.
+func makeQuitChannel(config ServerConfig, req *http.Request) chan struct{} {
+	quitChannel, _ := makeStoppableQuitChannel(config, req)
+	return quitChannel
+}
+
+// makeStoppableQuitChannel is like `makeQuitChannel`, but the channel is also closed when
+// `stop` is called, e.g. because the client has all the results it asked for.
+func makeStoppableQuitChannel(config ServerConfig, req *http.Request) (chan struct{}, func()) {
+	quitChannel := make(chan struct{})
+	stopChannel := make(chan struct{})
+	go func() {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(config.TimeOutQuery):
+		case <-stopChannel:
+		}
+		close(quitChannel)
+	}()
+
+	var once sync.Once
+	stop := func() { once.Do(func() { close(stopChannel) }) }
+	return quitChannel, stop
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
 	}
 }
 
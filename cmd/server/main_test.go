@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iafisher/fast-concordance/internal/concordance"
+	"github.com/iafisher/fast-concordance/internal/querylane"
+	"github.com/iafisher/fast-concordance/internal/resultcache"
+)
+
+func TestChooseLanes(t *testing.T) {
+	config := ServerConfig{
+		MainLane:      querylane.NewLane("main", 4),
+		CheapLane:     querylane.NewLane("cheap", 2),
+		CheapHits:     1000,
+		ExpensiveHits: 100000,
+	}
+
+	// A rare keyword without the index, which scans the whole corpus (~600 MB for the full
+	// set of books) for its few hits, is as cheap as any other query with few hits.
+	lanes, weight := chooseLanes(config, 12)
+	if len(lanes) != 2 || lanes[0] != config.CheapLane || weight != 1 {
+		t.Fatalf("expected a rare keyword to be cheap, got %d lane(s) and weight %d", len(lanes), weight)
+	}
+
+	// the frontend's max_results
+	lanes, weight = chooseLanes(config, 10000)
+	if len(lanes) != 1 || lanes[0] != config.MainLane || weight != 1 {
+		t.Fatalf("expected a query capped at 10000 hits to take 1 slot, got %d lane(s) and weight %d", len(lanes), weight)
+	}
+
+	_, weight = chooseLanes(config, 50000)
+	if weight != 2 {
+		t.Fatalf("expected a query with 50000 hits to take 2 slots, got weight %d", weight)
+	}
+
+	_, weight = chooseLanes(config, 1000000)
+	if weight != 4 {
+		t.Fatalf("expected an expensive query to take the whole lane, got weight %d", weight)
+	}
+}
+
+func TestHandleConcordCache(t *testing.T) {
+	pages := concordance.Pages{
+		Pages:    []concordance.Page{{FileName: "a", Text: strings.Repeat("the whale ", 50)}},
+		Manifest: concordance.Manifest{},
+	}
+	corpus := &Corpus{Pages: pages, Index: concordance.BuildIndex(pages)}
+	config := ServerConfig{
+		MainLane:        querylane.NewLane("main", 4),
+		ResultCache:     resultcache.NewResultCache(1024 * 1024),
+		TimeOutQuery:    10 * time.Second,
+		FlushBytes:      1024,
+		ExpensiveHits:   100000,
+		ExpensivePolicy: EXPENSIVE_QUEUE,
+	}
+
+	// A truncated result is cached for queries with the same max_results.
+	for i, cached := range []bool{false, true} {
+		matches, _, _, trailer := sortLines(t, concord(t, config, corpus, "/concord?w=whale&max_results=10"))
+		if matches != 10 || trailer == nil || !trailer.Truncated || trailer.Total != 50 || trailer.Cached != cached {
+			t.Fatalf("query %d: unexpected result: %d match(es), trailer %+v", i+1, matches, trailer)
+		}
+	}
+
+	matches, _, _, trailer := sortLines(t, concord(t, config, corpus, "/concord?w=whale&max_results=20"))
+	if matches != 20 || trailer == nil || trailer.Cached {
+		t.Fatalf("unexpected result for a different max_results: %d match(es), trailer %+v", matches, trailer)
+	}
+
+	// A complete result answers a query with any max_results.
+	matches, _, _, trailer = sortLines(t, concord(t, config, corpus, "/concord?w=whale"))
+	if matches != 50 || trailer == nil || trailer.Truncated || trailer.Cached {
+		t.Fatalf("unexpected complete result: %d match(es), trailer %+v", matches, trailer)
+	}
+	matches, _, _, trailer = sortLines(t, concord(t, config, corpus, "/concord?w=whale&max_results=5"))
+	if matches != 5 || trailer == nil || !trailer.Truncated || trailer.Total != 50 || !trailer.Cached {
+		t.Fatalf("unexpected result from the complete result: %d match(es), trailer %+v", matches, trailer)
+	}
+}
+
+func concord(t *testing.T, config ServerConfig, corpus *Corpus, target string) []string {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handleConcord(config, corpus, recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", recorder.Code)
+	}
+
+	lines := []string{}
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/iafisher/fast-concordance/internal/concordance"
+)
+
+// matchWriter writes the matches for a query as NDJSON. Rather than flushing the response
+// after every match, it flushes once `ServerConfig.FlushBytes` have built up, or once the
+// oldest match that hasn't been sent has waited for `ServerConfig.FlushInterval`, so that
+// common words don't cost a write to the connection per match but the first results still
+// arrive promptly.
+type matchWriter struct {
+	config  ServerConfig
+	writer  http.ResponseWriter
+	flusher http.Flusher
+	// bytes written since the last flush
+	pending int
+	// started by the first write after a flush
+	timer *time.Timer
+}
+
+func newMatchWriter(config ServerConfig, writer http.ResponseWriter, flusher http.Flusher) *matchWriter {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &matchWriter{config: config, writer: writer, flusher: flusher, timer: timer}
+}
+
+func (out *matchWriter) write(match concordance.Match) {
+	jsonB, err := json.Marshal(match)
+	if err != nil {
+		return
+	}
+	out.writeLine(jsonB)
+}
+
+// writeLine writes a match that has already been encoded.
+func (out *matchWriter) writeLine(jsonB []byte) {
+	if out.pending == 0 && out.config.FlushInterval > 0 {
+		out.timer.Reset(out.config.FlushInterval)
+	}
+	out.writer.Write(jsonB)
+	out.writer.Write([]byte("\n"))
+	out.pending += len(jsonB) + 1
+
+	if out.pending >= out.config.FlushBytes || out.config.FlushInterval <= 0 || out.config.SlowMode {
+		out.flush()
+	}
+
+	if out.config.SlowMode {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// deadline returns a channel that receives when the matches that haven't been sent are due
+// to be flushed, or nil if there aren't any.
+func (out *matchWriter) deadline() <-chan time.Time {
+	if out.pending == 0 {
+		return nil
+	}
+	return out.timer.C
+}
+
+func (out *matchWriter) flush() {
+	out.timer.Stop()
+	out.pending = 0
+	out.flusher.Flush()
+}
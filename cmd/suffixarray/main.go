@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/iafisher/fast-concordance/internal/concordance"
+)
+
+func main() {
+	directory := flag.String("directory", "", "build a suffix array for this directory of ebook files")
+	output := flag.String("output", "", "write the suffix array to this file (default: suffixarray.bin in -directory)")
+	limitTexts := flag.Int("limit-texts", -1, "only include a subset of texts")
+	flag.Parse()
+
+	if *directory == "" {
+		fmt.Fprintln(os.Stderr, "-directory is required")
+		os.Exit(1)
+	}
+
+	path := *output
+	if path == "" {
+		path = fmt.Sprintf("%s/%s", *directory, concordance.SUFFIX_ARRAY_FILE_NAME)
+	}
+
+	pages, err := concordance.LoadPages(*directory, false, *limitTexts)
+	if err != nil {
+		log.Fatalf("could not load pages: %v", err)
+	}
+
+	err = concordance.WriteSuffixArray(pages, path)
+	if err != nil {
+		log.Fatalf("could not write suffix array: %v", err)
+	}
+	log.Printf("wrote suffix array for %d text(s) to %s", len(pages.Pages), path)
+}
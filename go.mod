@@ -4,4 +4,7 @@ go 1.23.0
 
 toolchain go1.23.7
 
-require golang.org/x/sync v0.13.0
+require (
+	golang.org/x/sync v0.13.0
+	golang.org/x/sys v0.30.0
+)
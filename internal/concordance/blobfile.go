@@ -0,0 +1,131 @@
+package concordance
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// Blob files are the on-disk format shared by the suffix array and the packed corpus. They
+// are laid out so that they can be memory-mapped and used in place:
+//
+//	magic             8 bytes, different for each kind of file
+//	byte-order mark   uint32, 0x01020304 in the writer's byte order
+//	header length     uint32
+//	header            JSON
+//	sections          raw bytes, each one padded to a multiple of 4 bytes
+//
+// Integers are written in the native byte order, so a file can only be read on machines
+// with the same endianness as the one that wrote it; `parseBlobFile` checks this.
+const blobFileByteOrderMark = 0x01020304
+
+// pages are separated by a NUL byte so that a match can never span two pages
+const pageSeparator = 0
+
+// blobPage is a page's place in the text of a blob file.
+type blobPage struct {
+	FileName string `json:"filename"`
+	Start    int    `json:"start"`
+	End      int    `json:"end"`
+}
+
+// concatenatePages joins the pages' text, separated by `pageSeparator`.
+func concatenatePages(pages Pages) ([]byte, []blobPage, error) {
+	text := []byte{}
+	blobPages := []blobPage{}
+	for i, page := range pages.Pages {
+		pageText, release, ok := loadPageText(page)
+		if !ok {
+			return nil, nil, errors.New("could not read " + page.FilePath)
+		}
+
+		if i > 0 {
+			text = append(text, pageSeparator)
+		}
+		start := len(text)
+		text = append(text, pageText...)
+		blobPages = append(blobPages, blobPage{FileName: page.FileName, Start: start, End: len(text)})
+		if release != nil {
+			release()
+		}
+	}
+	return text, blobPages, nil
+}
+
+func writeBlobFile(path string, magic string, header any, sections ...[]byte) error {
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that a crash can't leave a truncated file behind
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	offset := 0
+	write := func(data []byte) {
+		if err == nil {
+			_, err = w.Write(data)
+			offset += len(data)
+		}
+	}
+	pad := func() {
+		write(make([]byte, alignTo4(offset)-offset))
+	}
+
+	write([]byte(magic))
+	write(binary.NativeEndian.AppendUint32(nil, blobFileByteOrderMark))
+	write(binary.NativeEndian.AppendUint32(nil, uint32(len(headerJson))))
+	write(headerJson)
+	pad()
+	for _, section := range sections {
+		write(section)
+		pad()
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// parseBlobFile decodes the header of a blob file into `header`, and returns the offset of
+// the first section.
+func parseBlobFile(data []byte, magic string, header any) (int, error) {
+	if len(data) < 16 || string(data[:8]) != magic {
+		return 0, errors.New("wrong kind of file")
+	}
+
+	if binary.NativeEndian.Uint32(data[8:12]) != blobFileByteOrderMark {
+		return 0, errors.New("file was written on a machine with a different byte order")
+	}
+
+	headerLen := int(binary.NativeEndian.Uint32(data[12:16]))
+	offset := 16 + headerLen
+	if offset > len(data) {
+		return 0, errors.New("truncated header")
+	}
+
+	err := json.Unmarshal(data[16:offset], header)
+	if err != nil {
+		return 0, err
+	}
+	return alignTo4(offset), nil
+}
+
+func alignTo4(n int) int {
+	return (n + 3) &^ 3
+}
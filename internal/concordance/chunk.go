@@ -0,0 +1,329 @@
+package concordance
+
+import (
+	"log"
+	"runtime"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// the size of the pieces that long pages (and packed corpora) are split into, so that the
+// work is spread evenly across goroutines rather than the longest books setting the latency
+// of every query
+const CHUNK_SIZE = 1 << 18
+
+// the most matches that are sent on the output channel of `StreamSearch` at once. Each chunk's
+// matches are sent when the chunk is finished, or sooner if there are more than this.
+const MATCH_BATCH_SIZE = 256
+
+// chunk is a piece of a page's text to search.
+type chunk struct {
+	pageIndex int
+	start     int
+	// -1 for the whole page, which may not have been loaded yet
+	end int
+	// for a compressed page, the block to search, or -1 for the whole page
+	block int
+}
+
+// splitPages splits every page longer than `chunkSize` into chunks, and compressed pages
+// into their blocks if `canUseBlocks(overlap)`. Other pages, and pages whose text hasn't been
+// loaded, are searched whole. If `chunkSize` is -1, no page is split.
+func splitPages(pages []Page, chunkSize int, overlap int) []chunk {
+	chunks := make([]chunk, 0, len(pages))
+	for i, page := range pages {
+		if page.compressed != nil && chunkSize != -1 && canUseBlocks(overlap) {
+			for j := range page.compressed.blocks {
+				chunks = append(chunks, chunk{pageIndex: i, end: -1, block: j})
+			}
+			continue
+		}
+
+		if chunkSize == -1 || len(page.Text) <= chunkSize {
+			chunks = append(chunks, chunk{pageIndex: i, end: -1, block: -1})
+			continue
+		}
+
+		for start := 0; start < len(page.Text); start += chunkSize {
+			chunks = append(chunks, chunk{pageIndex: i, start: start, end: min(start+chunkSize, len(page.Text)), block: -1})
+		}
+	}
+	return chunks
+}
+
+// skipBlocks returns the chunks without the blocks whose signatures rule out all of
+// `keywords`, and how many blocks there were.
+func skipBlocks(pages []Page, chunks []chunk, keywords []string) ([]chunk, int) {
+	blocks := 0
+	r := chunks[:0]
+	for _, c := range chunks {
+		if c.block != -1 {
+			blocks += 1
+			sig := pages[c.pageIndex].compressed.signatures[c.block]
+			if !slices.ContainsFunc(keywords, sig.mayContain) {
+				continue
+			}
+		}
+		r = append(r, c)
+	}
+	return r, blocks
+}
+
+// chunkOverlap returns how far past its end a chunk is scanned for `keyword`: far enough to
+// take in the rest of a hit that starts in the chunk, and its right context.
+func chunkOverlap(keyword string) int {
+	return len(keyword) + CONTEXT_LENGTH
+}
+
+// canOverlapItself returns whether two occurrences of `keyword` can overlap, e.g. "a a" in
+// "a a a". The finders skip an occurrence that overlaps the previous one, which a chunk can't
+// do for an occurrence that overlaps one in the chunk before it, so such keywords aren't
+// searched in chunks, unless they are made only of letters, like "that": then one of two
+// overlapping occurrences ends inside the other, so neither is on word boundaries.
+func canOverlapItself(keyword string) bool {
+	for k := 1; k < len(keyword); k++ {
+		if keyword[:k] == keyword[len(keyword)-k:] {
+			return true
+		}
+	}
+	return false
+}
+
+// findInChunk calls `yield` on the hits in `text` that start in [start, end), scanning up to
+// `overlap` bytes further so that hits which cross `end` are found. Hits that start in the
+// overlap are left for the next chunk, so that each hit is reported by exactly one chunk.
+func findInChunk(finder IFinder, text string, start int, end int, overlap int, counts *chunkCounts, yield func(start int, end int) bool) {
+	scanEnd := min(end+overlap, len(text))
+	counts.bytesScanned += int64(scanEnd - start)
+	counts.startCpu()
+	defer counts.stopCpu()
+	finder.FindAll(Page{Text: text[start:scanEnd]}, func(hitStart int, hitEnd int) bool {
+		hitStart += start
+		hitEnd += start
+		if hitStart >= end {
+			return false
+		}
+		return yield(hitStart, hitEnd)
+	})
+}
+
+// chunkCounts are kept by a worker while it searches a chunk, and added to `SearchStats` once
+// the chunk is done, so that the workers don't contend for the stats on every hit.
+type chunkCounts struct {
+	bytesScanned int64
+	candidates   int64
+	rejected     int64
+	// CPU time spent in the finder, and when the current stretch of it started (see
+	// `startCpu`)
+	cpuTime  time.Duration
+	cpuStart time.Duration
+	metering bool
+}
+
+// startCpu starts counting CPU time towards `cpuTime`, until `stopCpu`. The goroutine is
+// locked to its thread in between, since the thread's CPU time is only the chunk's if the
+// goroutine stays on it.
+func (counts *chunkCounts) startCpu() {
+	runtime.LockOSThread()
+	counts.cpuStart = threadCpuTime()
+	counts.metering = true
+}
+
+func (counts *chunkCounts) stopCpu() {
+	counts.cpuTime += threadCpuTime() - counts.cpuStart
+	counts.metering = false
+	runtime.UnlockOSThread()
+}
+
+// unmetered wraps `emit` so that, if it is called while CPU time is being counted, the time
+// it spends blocked on a slow reader isn't counted, and doesn't hold the thread.
+func (counts *chunkCounts) unmetered(emit func(batch []Match) bool) func(batch []Match) bool {
+	return func(batch []Match) bool {
+		if !counts.metering {
+			return emit(batch)
+		}
+
+		counts.stopCpu()
+		defer counts.startCpu()
+		return emit(batch)
+	}
+}
+
+// onWordBoundaries is `isOnWordBoundaries`, but it counts the hit as a candidate, and as
+// rejected if it isn't on word boundaries.
+func (counts *chunkCounts) onWordBoundaries(text string, start int, end int) bool {
+	counts.candidates += 1
+	if !isOnWordBoundaries(text, start, end) {
+		counts.rejected += 1
+		return false
+	}
+	return true
+}
+
+// searchChunk calls `search` to search a chunk, and adds what it counted, and the time it
+// took, to `stats`.
+func searchChunk(stats *SearchStats, search func(counts *chunkCounts)) {
+	startTime := time.Now()
+	counts := chunkCounts{}
+	search(&counts)
+	stats.addChunk(time.Since(startTime), counts)
+}
+
+// pageLimits enforces `SearchOptions.PerPageLimit` across chunks of the same page that are
+// searched concurrently.
+type pageLimits struct {
+	limit      int
+	emitted    []atomic.Int64
+	suppressed []atomic.Int64
+}
+
+func newPageLimits(pages int, limit int) *pageLimits {
+	return &pageLimits{
+		limit:      limit,
+		emitted:    make([]atomic.Int64, pages),
+		suppressed: make([]atomic.Int64, pages),
+	}
+}
+
+// allow returns whether another match can be returned from page `i`, and counts it as
+// suppressed if not. Searches of a page that isn't allowed another match stop there, unless
+// the chunk holds other pages too.
+func (limits *pageLimits) allow(i int) bool {
+	if limits.limit > 0 && limits.emitted[i].Add(1) > int64(limits.limit) {
+		limits.suppressed[i].Add(1)
+		return false
+	}
+	return true
+}
+
+// full returns whether a match has already been suppressed in page `i`, so that the rest of
+// its chunks need not be searched.
+func (limits *pageLimits) full(i int) bool {
+	return limits.limit > 0 && limits.emitted[i].Load() > int64(limits.limit)
+}
+
+func (limits *pageLimits) addSuppressed(i int, n int) {
+	limits.suppressed[i].Add(int64(n))
+}
+
+// report adds the suppressed counts to `stats`; `fileName` gives the file name of page `i`.
+func (limits *pageLimits) report(stats *SearchStats, fileName func(i int) string) {
+	for i := range limits.suppressed {
+		n := limits.suppressed[i].Load()
+		if n > 0 {
+			stats.addSuppressed(fileName(i), int(n))
+		}
+	}
+}
+
+// batcher collects the matches from a chunk into batches of up to `MATCH_BATCH_SIZE`, so
+// that they go through the output channel together instead of one at a time.
+type batcher struct {
+	batch []Match
+	emit  func(batch []Match) bool
+}
+
+func (b *batcher) add(match Match) bool {
+	b.batch = append(b.batch, match)
+	if len(b.batch) < MATCH_BATCH_SIZE {
+		return true
+	}
+	return b.flush()
+}
+
+// flush emits the matches collected so far. It returns false if the search should stop.
+func (b *batcher) flush() bool {
+	if len(b.batch) == 0 {
+		return true
+	}
+	ok := b.emit(b.batch)
+	// The receiver owns the batch now.
+	b.batch = nil
+	return ok
+}
+
+// searchPages is the main loop of `StreamSearch`: it searches `pages` in chunks of
+// `chunkSize` bytes (see `splitPages`) for `keywords` and calls `emit` on each chunk's
+// matches, in batches, until it returns false.
+func searchPages(pages []Page, finder IFinder, keywords []string, overlap int, chunkSize int, options SearchOptions, stats *SearchStats, quitChannel chan struct{}, emit func(batch []Match) bool) {
+	chunks := splitPages(pages, chunkSize, overlap)
+	totalChunks := len(chunks)
+	chunks, stats.Blocks = skipBlocks(pages, chunks, keywords)
+	stats.SkippedBlocks = totalChunks - len(chunks)
+	limits := newPageLimits(len(pages), options.PerPageLimit)
+	scanned := make([]atomic.Bool, len(pages))
+
+	forEach(len(chunks), options.MaxGoroutines, func(i int) {
+		select {
+		case <-quitChannel:
+			return
+		default:
+		}
+
+		c := chunks[i]
+		if limits.full(c.pageIndex) {
+			return
+		}
+		page := pages[c.pageIndex]
+		scanned[c.pageIndex].Store(true)
+		searchChunk(stats, func(counts *chunkCounts) {
+			b := batcher{emit: counts.unmetered(emit)}
+			if c.block != -1 {
+				searchBlock(finder, page, c, overlap, limits, counts, b.add)
+			} else if c.end == -1 {
+				suppressed := findMatches(finder, page, options.PerPageLimit, counts, b.add)
+				limits.addSuppressed(c.pageIndex, suppressed)
+			} else {
+				text := page.Text
+				findInChunk(finder, text, c.start, c.end, overlap, counts, func(start int, end int) bool {
+					if !counts.onWordBoundaries(text, start, end) {
+						return true
+					}
+
+					if !limits.allow(c.pageIndex) {
+						return false
+					}
+
+					return b.add(matchAt(finder, page.FileName, text, start, end))
+				})
+			}
+			b.flush()
+		})
+	})
+
+	limits.report(stats, func(i int) string { return pages[i].FileName })
+	stats.PagesScanned = countScanned(scanned)
+}
+
+func countScanned(scanned []atomic.Bool) int {
+	n := 0
+	for i := range scanned {
+		if scanned[i].Load() {
+			n += 1
+		}
+	}
+	return n
+}
+
+// searchBlock searches a block of a compressed page, like a chunk of any other page.
+func searchBlock(finder IFinder, page Page, c chunk, overlap int, limits *pageLimits, counts *chunkCounts, fn func(match Match) bool) {
+	text, before, err := page.compressed.block(c.block)
+	if err != nil {
+		log.Printf("failed to decompress page: %s (%s)", page.FileName, err)
+		return
+	}
+
+	block := page.compressed.blocks[c.block]
+	findInChunk(finder, text, before, before+block.End-block.Start, overlap, counts, func(start int, end int) bool {
+		if !counts.onWordBoundaries(text, start, end) {
+			return true
+		}
+
+		if !limits.allow(c.pageIndex) {
+			return false
+		}
+
+		return fn(matchAt(finder, page.FileName, text, start, end))
+	})
+}
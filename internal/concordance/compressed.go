@@ -0,0 +1,279 @@
+package concordance
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/iafisher/fast-concordance/internal/mmapfile"
+)
+
+// A compressed corpus is a blob file (see `blobfile.go`) with two sections: the pages' text,
+// in blocks of `COMPRESSED_BLOCK_SIZE` bytes that are compressed separately with DEFLATE, and
+// a signature (see `signature.go`) of each block. Only the blocks whose signatures allow a
+// hit are decompressed, so a query for a rare keyword only reads a small part of the corpus.
+const COMPRESSED_MAGIC = "FCDEFLAT"
+const COMPRESSED_FILE_NAME = "corpus.packz"
+const COMPRESSED_BLOCK_SIZE = 1 << 18
+
+// Each block holds up to this many bytes of the text either side of it, so that a hit near
+// the edge of a block, and its context, can be found without decompressing the next one.
+const COMPRESSED_BLOCK_MARGIN = 256
+
+type compressedHeader struct {
+	Pages          []compressedPageHeader `json:"pages"`
+	DataLen        int                    `json:"data_len"`
+	SignatureWords int                    `json:"signature_words"`
+	Manifest       json.RawMessage        `json:"manifest"`
+}
+
+type compressedPageHeader struct {
+	FileName  string            `json:"filename"`
+	TextLen   int               `json:"text_len"`
+	WordCount int               `json:"word_count"`
+	Blocks    []compressedBlock `json:"blocks"`
+}
+
+type compressedBlock struct {
+	// where the compressed text is in the first section
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+	// the part of the page that the block covers
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// the offset of `Start` in the block's text, which begins up to `COMPRESSED_BLOCK_MARGIN`
+	// bytes before it
+	Before int `json:"before"`
+	// where the signature of the block's text (including the margins) is in the second
+	// section, in 64-bit words
+	SignatureOffset int `json:"signature_offset"`
+	SignatureWords  int `json:"signature_words"`
+}
+
+// compressedPage is a page loaded by `LoadCompressed`.
+type compressedPage struct {
+	// the first section of the file
+	data       []byte
+	blocks     []compressedBlock
+	signatures []*signature
+	textLen    int
+}
+
+type compressedPageResult struct {
+	header     compressedPageHeader
+	data       []byte
+	signatures [][]uint64
+}
+
+// WriteCompressed writes `pages` and their manifest to `path` as a compressed corpus.
+func WriteCompressed(pages Pages, path string) error {
+	startTime := time.Now()
+	results := make([]compressedPageResult, len(pages.Pages))
+	errs := make([]error, len(pages.Pages))
+	forEachPage(pages.Pages, 0, func(i int, page Page) {
+		results[i], errs[i] = compressPage(page)
+	})
+
+	err := errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+
+	header := compressedHeader{Manifest: pages.ManifestJson}
+	data := []byte{}
+	signatures := []byte{}
+	for _, result := range results {
+		for i := range result.header.Blocks {
+			block := &result.header.Blocks[i]
+			block.Offset += len(data)
+			block.SignatureOffset = header.SignatureWords
+			block.SignatureWords = len(result.signatures[i])
+			header.SignatureWords += block.SignatureWords
+			for _, word := range result.signatures[i] {
+				signatures = binary.NativeEndian.AppendUint64(signatures, word)
+			}
+		}
+		data = append(data, result.data...)
+		header.Pages = append(header.Pages, result.header)
+	}
+	header.DataLen = len(data)
+
+	err = writeBlobFile(path, COMPRESSED_MAGIC, header, data, signatures)
+	if err != nil {
+		return err
+	}
+
+	durationMs := time.Since(startTime).Milliseconds()
+	log.Printf("compressed %d page(s) to %d KB of text and %d KB of signatures in %d ms", len(pages.Pages), len(data)/1024, len(signatures)/1024, durationMs)
+	return nil
+}
+
+// compressPage compresses the page's blocks. Their offsets are relative to the start of
+// the page's data.
+func compressPage(page Page) (compressedPageResult, error) {
+	text, release, ok := loadPageText(page)
+	if !ok {
+		return compressedPageResult{}, errors.New("could not read " + page.FilePath)
+	}
+	if release != nil {
+		defer release()
+	}
+
+	result := compressedPageResult{header: compressedPageHeader{FileName: page.FileName, TextLen: len(text), WordCount: CountWords(text)}}
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return compressedPageResult{}, err
+	}
+
+	for start := 0; start < len(text); start += COMPRESSED_BLOCK_SIZE {
+		end := min(start+COMPRESSED_BLOCK_SIZE, len(text))
+		blockStart := max(0, start-COMPRESSED_BLOCK_MARGIN)
+		blockText := text[blockStart:min(end+COMPRESSED_BLOCK_MARGIN, len(text))]
+
+		offset := buffer.Len()
+		writer.Reset(&buffer)
+		_, err = writer.Write([]byte(blockText))
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			return compressedPageResult{}, err
+		}
+
+		result.header.Blocks = append(result.header.Blocks, compressedBlock{
+			Offset: offset,
+			Length: buffer.Len() - offset,
+			Start:  start,
+			End:    end,
+			Before: start - blockStart,
+		})
+		result.signatures = append(result.signatures, newSignature(blockText).bits)
+	}
+
+	result.data = buffer.Bytes()
+	return result, nil
+}
+
+// LoadCompressed memory-maps a compressed corpus written by `WriteCompressed`. The pages'
+// text is decompressed whenever it is needed, so `Page.Text` is empty.
+func LoadCompressed(path string) (Pages, error) {
+	file, err := mmapfile.Open(path)
+	if err != nil {
+		return Pages{}, err
+	}
+
+	pages, err := parseCompressed(file.Data)
+	if err != nil {
+		file.Close()
+		return Pages{}, fmt.Errorf("could not load compressed corpus from %s: %w", path, err)
+	}
+	pages.mappedFiles = []*mmapfile.File{file}
+	return pages, nil
+}
+
+func parseCompressed(data []byte) (Pages, error) {
+	var header compressedHeader
+	offset, err := parseBlobFile(data, COMPRESSED_MAGIC, &header)
+	if err != nil {
+		return Pages{}, err
+	}
+
+	signaturesStart := alignTo4(offset + header.DataLen)
+	if alignTo4(signaturesStart+header.SignatureWords*8) != len(data) {
+		return Pages{}, errors.New("file size does not match header")
+	}
+
+	manifest, err := ParseManifest(header.Manifest)
+	if err != nil {
+		return Pages{}, fmt.Errorf("could not parse manifest: %w", err)
+	}
+
+	// The signatures are copied out, since the section isn't 8-byte aligned.
+	words := make([]uint64, header.SignatureWords)
+	for i := range words {
+		words[i] = binary.NativeEndian.Uint64(data[signaturesStart+i*8:])
+	}
+
+	compressedData := data[offset : offset+header.DataLen]
+	pages := make([]Page, 0, len(header.Pages))
+	signatureWords := 0
+	for _, p := range header.Pages {
+		compressed := &compressedPage{data: compressedData, blocks: p.Blocks, textLen: p.TextLen}
+		for _, block := range p.Blocks {
+			if block.Offset+block.Length > header.DataLen || block.SignatureOffset+block.SignatureWords > header.SignatureWords {
+				return Pages{}, errors.New("block out of range")
+			}
+			// The signatures are written one after another, and `signature.mask` only works
+			// if each one is a power of two words long.
+			if block.SignatureOffset != signatureWords || block.SignatureWords <= 0 || block.SignatureWords&(block.SignatureWords-1) != 0 {
+				return Pages{}, errors.New("bad block signature")
+			}
+			signatureWords += block.SignatureWords
+
+			bits := words[block.SignatureOffset : block.SignatureOffset+block.SignatureWords]
+			compressed.signatures = append(compressed.signatures, &signature{bits: bits, mask: uint64(len(bits)*64 - 1)})
+		}
+		pages = append(pages, Page{FileName: p.FileName, WordCount: p.WordCount, compressed: compressed})
+	}
+	if signatureWords != header.SignatureWords {
+		return Pages{}, errors.New("signatures do not match header")
+	}
+
+	return Pages{Pages: pages, Manifest: manifest, ManifestJson: header.Manifest}, nil
+}
+
+var flateReaderPool = sync.Pool{}
+
+// block decompresses the `i`th block, and returns its text and the offset of the start of
+// the block in it (see `compressedBlock.Before`).
+func (compressed *compressedPage) block(i int) (string, int, error) {
+	block := compressed.blocks[i]
+	source := bytes.NewReader(compressed.data[block.Offset : block.Offset+block.Length])
+
+	var reader io.ReadCloser
+	if pooled := flateReaderPool.Get(); pooled != nil {
+		reader = pooled.(io.ReadCloser)
+		reader.(flate.Resetter).Reset(source, nil)
+	} else {
+		reader = flate.NewReader(source)
+	}
+	defer flateReaderPool.Put(reader)
+
+	// The margins are at most `COMPRESSED_BLOCK_MARGIN` bytes each, and `ReadFrom` wants
+	// `MinRead` bytes to spare.
+	text := bytes.NewBuffer(make([]byte, 0, block.End-block.Start+2*COMPRESSED_BLOCK_MARGIN+bytes.MinRead))
+	_, err := text.ReadFrom(reader)
+	if err != nil {
+		return "", 0, err
+	}
+	return bytesToString(text.Bytes()), block.Before, nil
+}
+
+// text decompresses the whole page.
+func (compressed *compressedPage) text() (string, error) {
+	text := make([]byte, 0, compressed.textLen)
+	for i, block := range compressed.blocks {
+		blockText, before, err := compressed.block(i)
+		if err != nil {
+			return "", err
+		}
+		text = append(text, blockText[before:before+block.End-block.Start]...)
+	}
+	return bytesToString(text), nil
+}
+
+// canUseBlocks returns whether the hits that start in a block can be found, along with
+// their context, in the block's text, when the chunk overlap is `overlap` (see
+// `findInChunk`). Otherwise the pages are decompressed whole.
+func canUseBlocks(overlap int) bool {
+	// `matchAt` may go a few bytes past `CONTEXT_LENGTH` to finish a UTF-8 character.
+	return overlap+4 <= COMPRESSED_BLOCK_MARGIN
+}
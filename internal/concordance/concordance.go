@@ -5,14 +5,20 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
+	"unsafe"
+
+	"github.com/iafisher/fast-concordance/internal/mmapfile"
 )
 
 type Match struct {
 	FileName string `json:"filename"`
 	Left     string `json:"left"`
 	Right    string `json:"right"`
+	// which keyword matched, for searches for more than one (see `StreamSearchMulti`)
+	Pattern string `json:"pattern,omitempty"`
 }
 
 const CONTEXT_LENGTH = 40
@@ -48,79 +54,309 @@ func SliceRightUtf8(text string, index int, end int) string {
 	}
 }
 
+// IFinder finds the occurrences of a keyword in a page. Filtering for word boundaries and
+// building each `Match` is left to `FindMatches`, so that every implementation behaves the
+// same way.
 type IFinder interface {
-	Find(page Page, outChannel chan Match, quitChannel chan struct{})
+	// FindAll calls `yield` with the start and end offsets of each non-overlapping
+	// occurrence of the keyword in `page.Text`, in increasing order of start, until `yield`
+	// returns false.
+	FindAll(page Page, yield func(start int, end int) bool)
+}
+
+func isOnWordBoundaries(text string, start int, end int) bool {
+	// TODO: this doesn't work with Unicode
+	if start > 0 && isLetter(text[start-1]) {
+		return false
+	}
+
+	if end < len(text) && isLetter(text[end]) {
+		return false
+	}
+
+	return true
+}
+
+// matchAt returns the match for an occurrence of the keyword at `text[start:end]`, found by
+// `finder`.
+func matchAt(finder IFinder, fileName string, text string, start int, end int) Match {
+	leftStart := max(0, start-CONTEXT_LENGTH)
+	rightEnd := min(end+CONTEXT_LENGTH, len(text))
+	match := Match{
+		FileName: fileName,
+		Left:     SliceLeftUtf8(text, start, leftStart),
+		Right:    SliceRightUtf8(text, end, rightEnd),
+	}
+	if multiFinder, ok := finder.(IMultiFinder); ok {
+		match.Pattern = multiFinder.KeywordAt(text, start, end)
+	}
+	return match
+}
+
+// FindMatches calls `fn` on each match of `finder` in the page, until `fn` returns false.
+//
+// If `limit` is positive, at most `limit` matches are passed to `fn`, and the search stops at
+// the next match after that rather than scan the rest of the page. It returns 1 if there was
+// such a match, and 0 otherwise.
+func FindMatches(finder IFinder, page Page, limit int, fn func(match Match) bool) int {
+	return findMatches(finder, page, limit, &chunkCounts{}, fn)
+}
+
+func findMatches(finder IFinder, page Page, limit int, counts *chunkCounts, fn func(match Match) bool) int {
+	text, release, ok := loadPageText(page)
+	if !ok {
+		return 0
+	}
+	page.Text = text
+	if release != nil {
+		defer release()
+	}
+
+	// The offset finders don't read the text.
+	if _, isOffsetFinder := finder.(*OffsetFinder); !isOffsetFinder {
+		counts.bytesScanned += int64(len(text))
+	}
+
+	emitted := 0
+	suppressed := 0
+	counts.startCpu()
+	defer counts.stopCpu()
+	finder.FindAll(page, func(start int, end int) bool {
+		if !counts.onWordBoundaries(text, start, end) {
+			return true
+		}
+
+		if limit > 0 && emitted == limit {
+			suppressed = 1
+			return false
+		}
+
+		match := matchAt(finder, page.FileName, text, start, end)
+		if release != nil {
+			// the match will outlive the mapping
+			match.Left = strings.Clone(match.Left)
+			match.Right = strings.Clone(match.Right)
+		}
+		emitted += 1
+		return fn(match)
+	})
+	return suppressed
 }
 
 type Pages struct {
 	Pages        []Page
+	Manifest     Manifest
 	ManifestJson []byte
+	// for pages loaded by `LoadPagesMmap` or `LoadPacked`
+	mappedFiles []*mmapfile.File
+	// for pages loaded by `LoadPacked`
+	packed *packedCorpus
 }
 
 type Page struct {
 	FileName string
 	FilePath string
 	Text     string
+	// 0 if not computed at load time, in which case `lazyWordCount` keeps it once it has been
+	// (see `pageWordCount`)
+	WordCount     int
+	lazyWordCount *lazyWordCount
+	// if true and `Text` is empty, `FilePath` is mapped when needed instead of read
+	mmap bool
+	// if set and `Text` is empty, `FilePath` is read through the cache when needed
+	cache *PageCache
+	// for pages loaded by `LoadCompressed`, whose text is decompressed when needed
+	compressed *compressedPage
+	// nil unless `BuildSignatures` has been called
+	signature *signature
 }
 
 func LoadPages(directory string, fileNamesOnly bool, limit int) (Pages, error) {
+	return loadPages(directory, fileNamesOnly, limit, false, nil)
+}
+
+// LoadPagesMmap is like `LoadPages`, but memory-maps each text instead of reading it into
+// the Go heap, so that loading is nearly instant and the kernel pages texts in and out as
+// they are searched. `Pages.Close` must be called once the pages are no longer needed.
+//
+// With `fileNamesOnly`, nothing is mapped up front; instead, each search maps the texts and
+// unmaps them once it's done with them.
+//
+// Unlike `LoadPages`, this doesn't count the words in each page, since that would mean
+// reading every text.
+func LoadPagesMmap(directory string, fileNamesOnly bool, limit int) (Pages, error) {
+	return loadPages(directory, fileNamesOnly, limit, true, nil)
+}
+
+// LoadPagesWhere is like `LoadPages`, or `LoadPagesMmap` if `useMmap` is true, but only loads
+// the books for which `keep` returns true. The other books' texts are never opened.
+func LoadPagesWhere(directory string, fileNamesOnly bool, limit int, useMmap bool, keep func(fileName string) bool) (Pages, error) {
+	return loadPages(directory, fileNamesOnly, limit, useMmap, keep)
+}
+
+// If `keep` is nil, every book is loaded.
+func loadPages(directory string, fileNamesOnly bool, limit int, useMmap bool, keep func(fileName string) bool) (Pages, error) {
 	files, err := os.ReadDir(directory)
 	if err != nil {
 		return Pages{}, err
 	}
 
 	pages := []Page{}
+	mappedFiles := []*mmapfile.File{}
 	for _, file := range files {
 		if limit != -1 && len(pages) == limit {
 			break
 		}
 
-		txtPath := fmt.Sprintf("%s/%s/merged.txt", directory, file.Name())
-		if file.IsDir() {
-			data := []byte{}
-			if !fileNamesOnly {
-				data, err = os.ReadFile(txtPath)
-				if err != nil {
-					log.Printf("failed to load file: %s (%s)", txtPath, err)
-					continue
-				}
+		if file.IsDir() && (keep == nil || keep(file.Name())) {
+			page, mappedFile, err := loadPage(directory, file.Name(), fileNamesOnly, useMmap)
+			if err != nil {
+				log.Printf("%s", err)
+				continue
+			}
+			if mappedFile != nil {
+				mappedFiles = append(mappedFiles, mappedFile)
 			}
 
-			pages = append(pages, Page{FileName: file.Name(), FilePath: txtPath, Text: string(data)})
+			pages = append(pages, page)
 		}
 	}
 
-	manifestJson, err := os.ReadFile(fmt.Sprintf("%s/manifest.json", directory))
+	manifestJson, manifest, err := loadManifest(directory)
 	if err != nil {
 		return Pages{}, err
 	}
 
-	return Pages{Pages: pages, ManifestJson: manifestJson}, nil
+	return Pages{Pages: pages, Manifest: manifest, ManifestJson: manifestJson, mappedFiles: mappedFiles}, nil
 }
 
-func StreamSearch(pages Pages, keyword string, quitChannel chan struct{}, maxGoroutines int) (chan Match, error) {
-	startTime := time.Now()
+// loadPage loads the book in `directory/fileName`. If `useMmap` is true, its text is mapped
+// rather than read, and the mapped file is returned too.
+func loadPage(directory string, fileName string, fileNamesOnly bool, useMmap bool) (Page, *mmapfile.File, error) {
+	txtPath := fmt.Sprintf("%s/%s/merged.txt", directory, fileName)
+	page := Page{FileName: fileName, FilePath: txtPath, mmap: useMmap, lazyWordCount: &lazyWordCount{}}
+	if fileNamesOnly {
+		return page, nil, nil
+	}
 
-	var wg sync.WaitGroup
-	outChannel := make(chan Match, 1000)
+	if useMmap {
+		mappedFile, err := mmapfile.Open(txtPath)
+		if err != nil {
+			return Page{}, nil, fmt.Errorf("failed to map file: %s (%s)", txtPath, err)
+		}
+		page.Text = bytesToString(mappedFile.Data)
+		return page, mappedFile, nil
+	}
 
-	finder, err := NewFinder(keyword)
+	data, err := os.ReadFile(txtPath)
 	if err != nil {
-		return nil, err
+		return Page{}, nil, fmt.Errorf("failed to load file: %s (%s)", txtPath, err)
 	}
+	page.Text = string(data)
+	page.WordCount = CountWords(page.Text)
+	return page, nil, nil
+}
+
+func loadManifest(directory string) ([]byte, Manifest, error) {
+	manifestJson, err := os.ReadFile(fmt.Sprintf("%s/manifest.json", directory))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, err := ParseManifest(manifestJson)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse manifest: %w", err)
+	}
+	return manifestJson, manifest, nil
+}
+
+// Close releases the memory-mapped texts of pages loaded by `LoadPagesMmap`. The pages'
+// text, and any `Match` taken from it, must not be used afterwards.
+func (pages *Pages) Close() {
+	for _, file := range pages.mappedFiles {
+		file.Close()
+	}
+	pages.mappedFiles = nil
+}
+
+// bytesToString returns a string that shares memory with `data`, which must not be
+// modified afterwards.
+func bytesToString(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	return unsafe.String(&data[0], len(data))
+}
+
+// loadPageText returns the page's text, reading it from disk (or its `PageCache`) if the
+// page was loaded with `fileNamesOnly`.
+//
+// If the page was loaded by `LoadPagesMmap`, the file is mapped instead, and `release` is
+// non-nil. It must be called once the text is no longer needed, after which the text, and
+// any substring of it, must not be used.
+func loadPageText(page Page) (text string, release func(), ok bool) {
+	if len(page.Text) != 0 {
+		return page.Text, nil, true
+	}
+
+	if page.cache != nil {
+		text, ok := page.cache.get(page.FilePath)
+		return text, nil, ok
+	}
+
+	if page.compressed != nil {
+		text, err := page.compressed.text()
+		if err != nil {
+			log.Printf("failed to decompress page: %s (%s)", page.FileName, err)
+			return "", nil, false
+		}
+		return text, nil, true
+	}
+
+	if page.mmap {
+		file, err := mmapfile.Open(page.FilePath)
+		if err != nil {
+			log.Printf("failed to map file: %s (%s)", page.FilePath, err)
+			return "", nil, false
+		}
+		return bytesToString(file.Data), func() { file.Close() }, true
+	}
+
+	bytes, err := os.ReadFile(page.FilePath)
+	if err != nil {
+		log.Printf("failed to read file: %s (%s)", page.FilePath, err)
+		return "", nil, false
+	}
+	return string(bytes), nil, true
+}
+
+// forEachPage calls `fn` on every page (with its index) and returns once all the calls
+// have finished.
+//
+// `maxGoroutines` is the number of goroutines to spread the pages across: -1 for one per
+// page, or 0 for one per CPU core.
+func forEachPage(pages []Page, maxGoroutines int, fn func(i int, page Page)) {
+	forEach(len(pages), maxGoroutines, func(i int) {
+		fn(i, pages[i])
+	})
+}
+
+// forEach calls `fn` on every integer in [0, n), like `forEachPage`.
+func forEach(n int, maxGoroutines int, fn func(i int)) {
+	var wg sync.WaitGroup
 
 	if maxGoroutines == -1 {
-		for _, page := range pages.Pages {
+		for i := 0; i < n; i++ {
 			wg.Add(1)
-			go func(page Page) {
+			go func(i int) {
 				defer wg.Done()
-				finder.Find(page, outChannel, quitChannel)
-			}(page)
+				fn(i)
+			}(i)
 		}
 	} else {
-		workChannel := make(chan Page, len(pages.Pages))
+		workChannel := make(chan int, n)
 
-		maxGoroutines = min(len(pages.Pages), maxGoroutines)
+		maxGoroutines = min(n, maxGoroutines)
 		if maxGoroutines == 0 {
 			maxGoroutines = runtime.NumCPU()
 		}
@@ -128,8 +364,8 @@ func StreamSearch(pages Pages, keyword string, quitChannel chan struct{}, maxGor
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for _, page := range pages.Pages {
-				workChannel <- page
+			for i := 0; i < n; i++ {
+				workChannel <- i
 			}
 			close(workChannel)
 		}()
@@ -138,19 +374,249 @@ func StreamSearch(pages Pages, keyword string, quitChannel chan struct{}, maxGor
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				for page := range workChannel {
-					finder.Find(page, outChannel, quitChannel)
+				for i := range workChannel {
+					fn(i)
 				}
 			}()
 		}
 	}
 
+	wg.Wait()
+}
+
+type SearchOptions struct {
+	// -1 for one goroutine per page, 0 for one per CPU core
+	MaxGoroutines int
+	// if positive, the maximum number of matches to return from a single page (which ones is
+	// unspecified if the page is split into chunks)
+	PerPageLimit int
+	// the size of the chunks that long pages are split into: 0 for `CHUNK_SIZE`, or -1 to
+	// search every page whole
+	ChunkSize int
+	// one of `FinderNames()`, or "" or `FINDER_AUTO` to choose one with `ChooseFinder`
+	Finder string
+	// if not nil, the "index" finder is available, and `ChooseFinder` uses it for keywords
+	// that it can answer
+	Index *Index
+	// if not nil, the "suffix-array" finder is available, and `ChooseFinder` uses it for
+	// keywords that `Index` can't answer; the pages must come from `SuffixArray.Pages()`
+	SuffixArray *SuffixArray
+}
+
+// SearchStats is filled in by `StreamSearch` as the search runs. It is complete once the
+// output channel has been closed, and must not be read before then.
+type SearchStats struct {
+	// a lower bound on the number of matches left out because of `PerPageLimit`, by file
+	// name: a page (or a chunk of one) isn't searched any further once it is over the limit
+	Suppressed map[string]int
+	// how long each chunk (see `SearchOptions.ChunkSize`) took to search, in the order they
+	// finished
+	ChunkDurations []time.Duration
+	// number of pages that weren't searched because their signature ruled them out (see
+	// `BuildSignatures`)
+	SkippedPages int
+	// likewise for the blocks of a compressed corpus (see `LoadCompressed`), and the number
+	// of blocks there were
+	SkippedBlocks int
+	Blocks        int
+	// number of pages that were searched, at least in part, and bytes of text that were
+	// scanned (0 for the offset finders, which look the hits up instead)
+	PagesScanned int
+	BytesScanned int64
+	// number of hits the finder found, and how many of them weren't on word boundaries and
+	// so weren't matches
+	Candidates int64
+	Rejected   int64
+	// CPU time that the workers spent in the finders, not counting the time spent sending
+	// matches (0 on platforms other than Linux)
+	CpuTime time.Duration
+	// how long after the search started the first and last batches of matches were sent,
+	// or 0 if there were no matches
+	FirstMatch time.Duration
+	LastMatch  time.Duration
+	mu         sync.Mutex
+}
+
+// QueryStats is a summary of `SearchStats` for logs and clients, which can be added up across
+// searches of different parts of the corpus.
+type QueryStats struct {
+	PagesScanned int     `json:"pages_scanned"`
+	PagesSkipped int     `json:"pages_skipped"`
+	BytesScanned int64   `json:"bytes_scanned"`
+	Candidates   int64   `json:"candidates"`
+	Rejected     int64   `json:"rejected"`
+	CpuMs        float64 `json:"cpu_ms"`
+	// 0 if there were no matches
+	FirstMatchMs float64 `json:"first_match_ms"`
+	LastMatchMs  float64 `json:"last_match_ms"`
+}
+
+// Summary returns the stats as a `QueryStats`. Like the other fields, it must not be called
+// before the output channel has been closed.
+func (stats *SearchStats) Summary() QueryStats {
+	return QueryStats{
+		PagesScanned: stats.PagesScanned,
+		PagesSkipped: stats.SkippedPages,
+		BytesScanned: stats.BytesScanned,
+		Candidates:   stats.Candidates,
+		Rejected:     stats.Rejected,
+		CpuMs:        durationMs(stats.CpuTime),
+		FirstMatchMs: durationMs(stats.FirstMatch),
+		LastMatchMs:  durationMs(stats.LastMatch),
+	}
+}
+
+// Add adds `other`, from a search that ran alongside this one, to the stats.
+func (stats *QueryStats) Add(other QueryStats) {
+	stats.PagesScanned += other.PagesScanned
+	stats.PagesSkipped += other.PagesSkipped
+	stats.BytesScanned += other.BytesScanned
+	stats.Candidates += other.Candidates
+	stats.Rejected += other.Rejected
+	stats.CpuMs += other.CpuMs
+	if other.FirstMatchMs > 0 && (stats.FirstMatchMs == 0 || other.FirstMatchMs < stats.FirstMatchMs) {
+		stats.FirstMatchMs = other.FirstMatchMs
+	}
+	stats.LastMatchMs = max(stats.LastMatchMs, other.LastMatchMs)
+}
+
+func (stats QueryStats) String() string {
+	return fmt.Sprintf(
+		"scanned %d page(s) (%d skipped), %.1f MB; %d candidate(s), %d rejected; cpu %.1f ms; first match %.1f ms, last %.1f ms",
+		stats.PagesScanned, stats.PagesSkipped, float64(stats.BytesScanned)/(1024*1024), stats.Candidates, stats.Rejected, stats.CpuMs, stats.FirstMatchMs, stats.LastMatchMs,
+	)
+}
+
+func durationMs(duration time.Duration) float64 {
+	return float64(duration.Microseconds()) / 1000
+}
+
+func (stats *SearchStats) addChunk(duration time.Duration, counts chunkCounts) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.ChunkDurations = append(stats.ChunkDurations, duration)
+	stats.CpuTime += counts.cpuTime
+	stats.BytesScanned += counts.bytesScanned
+	stats.Candidates += counts.candidates
+	stats.Rejected += counts.rejected
+}
+
+func (stats *SearchStats) addBatch(sinceStart time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if stats.FirstMatch == 0 {
+		stats.FirstMatch = sinceStart
+	}
+	stats.LastMatch = max(stats.LastMatch, sinceStart)
+}
+
+func (stats *SearchStats) addSuppressed(fileName string, n int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.Suppressed[fileName] += n
+}
+
+// StreamSearch searches `pages` for `keyword` in the background and sends the matches on the
+// returned channel in batches (see `MATCH_BATCH_SIZE`), which belong to the receiver. The
+// channel is closed once the search is finished, or has given up because `quitChannel` was
+// closed.
+func StreamSearch(pages Pages, keyword string, quitChannel chan struct{}, options SearchOptions) (chan []Match, *SearchStats, error) {
+	finderName := options.Finder
+	if finderName == "" {
+		finderName = FINDER_AUTO
+	}
+	finder, err := NewFinderByName(finderName, keyword, pages, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, stats := streamSearch(pages, finder, []string{keyword}, quitChannel, options)
+	return ch, stats, nil
+}
+
+// StreamSearchMulti is like `StreamSearch`, but it looks for any of `keywords` in a single
+// pass over the corpus, and sets `Match.Pattern` to the keyword that matched. The matches
+// are the same as searching for each keyword in turn. `options.Finder` is ignored.
+func StreamSearchMulti(pages Pages, keywords []string, quitChannel chan struct{}, options SearchOptions) (chan []Match, *SearchStats, error) {
+	finder, err := NewAhoCorasickFinder(keywords)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, stats := streamSearch(pages, &finder, keywords, quitChannel, options)
+	return ch, stats, nil
+}
+
+// streamSearch runs `finder`, which looks for `keywords`, over `pages` in the background.
+func streamSearch(pages Pages, finder IFinder, keywords []string, quitChannel chan struct{}, options SearchOptions) (chan []Match, *SearchStats) {
+	startTime := time.Now()
+
+	outChannel := make(chan []Match, 100)
+	stats := &SearchStats{Suppressed: make(map[string]int)}
+
+	send := func(batch []Match) bool {
+		// `select` chooses at random if the channel has room too, so check first.
+		select {
+		case <-quitChannel:
+			return false
+		default:
+		}
+
+		select {
+		case outChannel <- batch:
+			stats.addBatch(time.Since(startTime))
+			return true
+		case <-quitChannel:
+			return false
+		}
+	}
+
+	// The offset finders look pages up by name and already know where the hits are, so
+	// there's nothing to gain from splitting pages for them.
+	chunkSize := options.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = CHUNK_SIZE
+	}
+	_, isOffsetFinder := finder.(*OffsetFinder)
+	if isOffsetFinder {
+		chunkSize = -1
+	}
+
+	overlap := 0
+	for _, keyword := range keywords {
+		if canOverlapItself(keyword) && !IsIndexable(keyword) {
+			chunkSize = -1
+		}
+		overlap = max(overlap, chunkOverlap(keyword))
+	}
+
+	// The offset finders don't scan the pages, so there's nothing to gain from skipping them
+	// either.
+	searchable := pages.Pages
+	if !isOffsetFinder {
+		searchable = []Page{}
+		for _, page := range pages.Pages {
+			if !canSkip(page, keywords) {
+				searchable = append(searchable, page)
+			}
+		}
+		stats.SkippedPages = len(pages.Pages) - len(searchable)
+	}
+
+	// A packed corpus is searched in chunks of the whole text, which can't skip pages.
+	packed := pages.packed
+	if packed == nil || len(packed.pages) != len(pages.Pages) || chunkSize == -1 || stats.SkippedPages > 0 {
+		packed = nil
+	}
+
 	go func() {
-		wg.Wait()
-		durationMs := time.Since(startTime).Milliseconds()
-		log.Printf("goroutines exited after %d ms", durationMs)
+		if packed != nil {
+			searchPacked(packed, finder, overlap, chunkSize, options, stats, quitChannel, send)
+		} else {
+			searchPages(searchable, finder, keywords, overlap, chunkSize, options, stats, quitChannel, send)
+		}
 		close(outChannel)
 	}()
 
-	return outChannel, nil
+	return outChannel, stats
 }
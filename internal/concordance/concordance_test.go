@@ -1,6 +1,16 @@
 package concordance
 
-import "testing"
+import (
+	"errors"
+	"math/rand/v2"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestSliceUtf8(t *testing.T) {
 	// the dash character is 3 bytes long
@@ -29,3 +39,1217 @@ func TestSliceUtf8(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestCountWords(t *testing.T) {
+	if CountWords("") != 0 {
+		t.Fatal()
+	}
+
+	if CountWords("  the café–au–lait, 42 times ") != 5 {
+		t.Fatal()
+	}
+}
+
+func TestBuildTimeline(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": "the vampire and the other vampire",
+		"b": "no vampires here at all",
+		"c": "one vampire",
+		"d": "a vampire without a date",
+	})
+	pages.Manifest["a"] = ManifestEntry{Year: 1897}
+	pages.Manifest["b"] = ManifestEntry{Year: 1890}
+	pages.Manifest["c"] = ManifestEntry{Year: 1920}
+
+	timeline, err := BuildTimeline(pages, "vampire", make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(timeline.Decades) != 2 || timeline.Partial {
+		t.Fatalf("unexpected timeline: %+v", timeline)
+	}
+
+	d1890 := timeline.Decades[0]
+	if d1890.Decade != 1890 || d1890.Books != 2 || d1890.Hits != 2 || d1890.Words != 11 {
+		t.Fatalf("unexpected bucket: %+v", d1890)
+	}
+
+	d1920 := timeline.Decades[1]
+	if d1920.Decade != 1920 || d1920.Hits != 1 || d1920.HitsPerMillion != 500_000 {
+		t.Fatalf("unexpected bucket: %+v", d1920)
+	}
+
+	if timeline.UndatedBooks != 1 || timeline.UndatedHits != 1 {
+		t.Fatalf("unexpected timeline: %+v", timeline)
+	}
+
+	// Mapped pages' words aren't counted when they are loaded, but only once, when needed.
+	directory := writeTestCorpus(t, map[string]string{
+		"a": "the vampire and the other vampire",
+		"b": "no vampires here at all",
+	})
+	mapped, err := LoadPagesMmap(directory, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+	mapped.Manifest = pages.Manifest
+
+	for i := 0; i < 2; i++ {
+		timeline, err = BuildTimeline(mapped, "vampire", make(chan struct{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(timeline.Decades) != 1 || timeline.Decades[0].Words != 11 || mapped.Pages[0].lazyWordCount.count != 6 {
+			t.Fatalf("unexpected timeline for mapped pages: %+v", timeline)
+		}
+	}
+
+	quitChannel := make(chan struct{})
+	close(quitChannel)
+	timeline, err = BuildTimeline(pages, "vampire", quitChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !timeline.Partial {
+		t.Fatalf("expected a partial timeline: %+v", timeline)
+	}
+}
+
+func makeTestPages(texts map[string]string) Pages {
+	pages := Pages{Manifest: Manifest{}}
+	for fileName, text := range texts {
+		pages.Pages = append(pages.Pages, Page{FileName: fileName, Text: text, WordCount: CountWords(text)})
+	}
+	sort.Slice(pages.Pages, func(i, j int) bool {
+		return pages.Pages[i].FileName < pages.Pages[j].FileName
+	})
+	return pages
+}
+
+func TestCompareKeyness(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": "The whale, the whale, the sea and the whale.",
+		"b": "The vampire and the sea. The vampire!",
+		"c": "The sea, the vampire, the night.",
+	})
+	pages.Manifest["a"] = ManifestEntry{Author: "Herman Melville"}
+	pages.Manifest["b"] = ManifestEntry{Author: "Bram Stoker"}
+	pages.Manifest["c"] = ManifestEntry{Author: "Bram Stoker"}
+
+	a, b := FilterPages(pages, PageFilter{Authors: []string{"herman melville"}})
+	if len(a.Pages) != 1 || len(b.Pages) != 2 {
+		t.Fatal()
+	}
+
+	keyness := CompareKeyness(a, b, KeynessOptions{Limit: 10, MinCount: 2}, make(chan struct{}))
+	if keyness.WordsA != 9 || keyness.WordsB != 13 {
+		t.Fatalf("unexpected word counts: %+v", keyness)
+	}
+
+	if len(keyness.Keywords) != 1 {
+		t.Fatalf("unexpected keywords: %+v", keyness.Keywords)
+	}
+
+	kw := keyness.Keywords[0]
+	if kw.Word != "whale" || kw.CountA != 3 || kw.CountB != 0 || kw.LogLikelihood <= 0 || kw.LogRatio <= 0 {
+		t.Fatalf("unexpected keyword: %+v", kw)
+	}
+}
+
+func TestCountNgrams(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": "in the end of the day, the end of the world, and the start of it all",
+	})
+
+	ngrams, err := CountNgrams(pages, "the", 3, NGRAM_START, 10, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ngrams.Hits != 5 || ngrams.Partial {
+		t.Fatalf("unexpected result: %+v", ngrams)
+	}
+
+	top := ngrams.Ngrams[0]
+	if top.Text != "the end of" || top.Count != 2 || len(top.Examples) != 2 {
+		t.Fatalf("unexpected top n-gram: %+v", top)
+	}
+
+	ngrams, err = CountNgrams(pages, "the", 2, NGRAM_END, 10, make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top = ngrams.Ngrams[0]
+	if top.Text != "of the" || top.Count != 2 {
+		t.Fatalf("unexpected top n-gram: %+v", top)
+	}
+
+	_, err = CountNgrams(pages, "the end", 2, NGRAM_START, 10, make(chan struct{}))
+	if !errors.Is(err, ErrNgramLength) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSampleSearch(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": strings.Repeat("the whale ", 100),
+		"b": strings.Repeat("a whale ", 10),
+		"c": "no hits here",
+	})
+
+	sample, err := SampleSearch(pages, "whale", 20, 42, make(chan struct{}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sample.Total != 110 || len(sample.Matches) != 20 || sample.Partial {
+		t.Fatalf("unexpected sample: total=%d, matches=%d", sample.Total, len(sample.Matches))
+	}
+
+	// same seed, same sample, even when scheduled differently
+	sample2, err := SampleSearch(pages, "whale", 20, 42, make(chan struct{}), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range sample.Matches {
+		if sample.Matches[i] != sample2.Matches[i] {
+			t.Fatalf("samples differ at %d: %+v != %+v", i, sample.Matches[i], sample2.Matches[i])
+		}
+	}
+
+	// asking for more than there are returns every hit
+	sample, err = SampleSearch(pages, "whale", 1000, 42, make(chan struct{}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sample.Matches) != 110 {
+		t.Fatalf("expected all hits, got %d", len(sample.Matches))
+	}
+}
+
+func TestStreamSearchPerPageLimit(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": strings.Repeat("the whale ", 10),
+		"b": "a whale and a whale",
+	})
+
+	ch, stats, err := StreamSearch(pages, "whale", make(chan struct{}), SearchOptions{PerPageLimit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for batch := range ch {
+		for _, match := range batch {
+			counts[match.FileName] += 1
+		}
+	}
+
+	if counts["a"] != 3 || counts["b"] != 2 {
+		t.Fatalf("unexpected counts: %v", counts)
+	}
+
+	// The search stops at the first match over the limit.
+	if len(stats.Suppressed) != 1 || stats.Suppressed["a"] != 1 {
+		t.Fatalf("unexpected suppressed counts: %v", stats.Suppressed)
+	}
+}
+
+func TestStreamSearchBatches(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": strings.Repeat("the whale ", 1000),
+		"b": "a whale",
+	})
+
+	for _, chunkSize := range []int{0, 1000, -1} {
+		ch, _, err := StreamSearch(pages, "whale", make(chan struct{}), SearchOptions{ChunkSize: chunkSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := 0
+		for batch := range ch {
+			if len(batch) == 0 || len(batch) > MATCH_BATCH_SIZE {
+				t.Fatalf("chunk size %d: batch of %d match(es)", chunkSize, len(batch))
+			}
+			n += len(batch)
+		}
+
+		if n != 1001 {
+			t.Fatalf("chunk size %d: got %d match(es), expected 1001", chunkSize, n)
+		}
+	}
+}
+
+func TestStreamSearchChunks(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": strings.Repeat("the whale, a whale a whale; whaler ", 20),
+		"b": "whale",
+	})
+
+	for _, keyword := range []string{"whale", "a whale", "a"} {
+		expected := collectMatches(t, pages, keyword, SearchOptions{ChunkSize: -1})
+		for chunkSize := 1; chunkSize <= 12; chunkSize++ {
+			actual := collectMatches(t, pages, keyword, SearchOptions{ChunkSize: chunkSize})
+			if !slices.Equal(expected, actual) {
+				t.Fatalf("chunk size %d: results for '%s' differ: %d != %d", chunkSize, keyword, len(actual), len(expected))
+			}
+		}
+	}
+
+	ch, stats, err := StreamSearch(pages, "whale", make(chan struct{}), SearchOptions{ChunkSize: 7, PerPageLimit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for batch := range ch {
+		n += len(batch)
+	}
+
+	// Chunks that were already being searched when the limit was reached may each add one.
+	if n != 6 || stats.Suppressed["a"] < 1 || stats.Suppressed["a"] > 55 {
+		t.Fatalf("unexpected counts: %d, %v", n, stats.Suppressed)
+	}
+
+	// The rest of the chunks of "a" aren't searched once a match has been suppressed.
+	chunks := (len(pages.Pages[0].Text)+6)/7 + 1
+	if len(stats.ChunkDurations) >= chunks {
+		t.Fatalf("unexpected number of chunks: %d of %d", len(stats.ChunkDurations), chunks)
+	}
+
+	ch, stats, err = StreamSearch(pages, "whale", make(chan struct{}), SearchOptions{ChunkSize: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+	}
+	if len(stats.ChunkDurations) != chunks {
+		t.Fatalf("unexpected number of chunks: %d", len(stats.ChunkDurations))
+	}
+}
+
+func TestStreamSearchChunksOverlappingWord(t *testing.T) {
+	// "that" can overlap itself, as in "thathat", but as it is all letters the overlapping
+	// hits are never matches, so it is still searched in chunks.
+	pages := makeTestPages(map[string]string{
+		"a": strings.Repeat("that and thathat, that. ", CHUNK_SIZE/10),
+	})
+
+	expected := collectMatches(t, pages, "that", SearchOptions{ChunkSize: -1})
+	actual := collectMatches(t, pages, "that", SearchOptions{})
+	if len(expected) != 2*CHUNK_SIZE/10 || !slices.Equal(expected, actual) {
+		t.Fatalf("chunked results for 'that' differ: %d != %d", len(actual), len(expected))
+	}
+
+	ch, stats, err := StreamSearch(pages, "that", make(chan struct{}), SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+	}
+	if len(stats.ChunkDurations) < 2 {
+		t.Fatalf("expected the page to be split into chunks, got %d", len(stats.ChunkDurations))
+	}
+}
+
+func TestBuildSignatures(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": strings.Repeat("Call me Ishmael. Some years ago, never mind how long precisely, I thought I would sail about a little and see the watery part of the world. ", 20),
+		"b": strings.Repeat("the whale swam on, and the whale dived. ", 50),
+		"c": "a vampire",
+	})
+
+	for _, keyword := range []string{"whale", "vampire", "the", "Ishmael", "wh", "nothing at all"} {
+		expected := collectMatches(t, pages, keyword, SearchOptions{})
+
+		withSignatures := Pages{Pages: slices.Clone(pages.Pages)}
+		BuildSignatures(withSignatures)
+		ch, stats, err := StreamSearch(withSignatures, keyword, make(chan struct{}), SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := []Match{}
+		for batch := range ch {
+			for _, match := range batch {
+				actual = append(actual, match)
+			}
+		}
+		sortMatchesFully(expected)
+		sortMatchesFully(actual)
+		if !slices.Equal(expected, actual) {
+			t.Fatalf("results for '%s' differ with signatures", keyword)
+		}
+
+		expectedSkipped := map[string]int{"whale": 2, "vampire": 2, "the": 1, "Ishmael": 2, "wh": 0, "nothing at all": 3}
+		if stats.SkippedPages != expectedSkipped[keyword] {
+			t.Fatalf("skipped %d page(s) for '%s', expected %d", stats.SkippedPages, keyword, expectedSkipped[keyword])
+		}
+	}
+}
+
+func TestSearchStats(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": "whale whales whale",
+		"b": "a narwhale",
+		"c": "nothing to see",
+	})
+
+	searchStats := func(pages Pages, options SearchOptions) *SearchStats {
+		ch, stats, err := StreamSearch(pages, "whale", make(chan struct{}), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range ch {
+		}
+		return stats
+	}
+
+	stats := searchStats(pages, SearchOptions{})
+	if stats.PagesScanned != 3 || stats.BytesScanned != 42 || stats.Candidates != 4 || stats.Rejected != 2 {
+		t.Fatalf("unexpected stats: %d page(s), %d byte(s), %d candidate(s), %d rejected", stats.PagesScanned, stats.BytesScanned, stats.Candidates, stats.Rejected)
+	}
+	if stats.FirstMatch <= 0 || stats.LastMatch < stats.FirstMatch {
+		t.Fatalf("unexpected match times: %v, %v", stats.FirstMatch, stats.LastMatch)
+	}
+
+	// the overlap between chunks is scanned twice
+	stats = searchStats(pages, SearchOptions{ChunkSize: 4})
+	if stats.PagesScanned != 3 || stats.BytesScanned <= 42 || stats.Candidates != 4 || stats.Rejected != 2 {
+		t.Fatalf("unexpected stats with chunks: %d page(s), %d byte(s), %d candidate(s), %d rejected", stats.PagesScanned, stats.BytesScanned, stats.Candidates, stats.Rejected)
+	}
+
+	withSignatures := Pages{Pages: slices.Clone(pages.Pages)}
+	BuildSignatures(withSignatures)
+	stats = searchStats(withSignatures, SearchOptions{})
+	if stats.PagesScanned != 2 || stats.SkippedPages != 1 || stats.BytesScanned != 28 {
+		t.Fatalf("unexpected stats with signatures: %d page(s), %d skipped, %d byte(s)", stats.PagesScanned, stats.SkippedPages, stats.BytesScanned)
+	}
+
+	stats = searchStats(pages, SearchOptions{Index: BuildIndex(pages)})
+	if stats.BytesScanned != 0 || stats.Candidates != 2 || stats.Rejected != 0 {
+		t.Fatalf("unexpected stats with the index: %d byte(s), %d candidate(s), %d rejected", stats.BytesScanned, stats.Candidates, stats.Rejected)
+	}
+}
+
+func TestEstimateHits(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": "whale whales whale",
+		"b": "a narwhale",
+		"c": "nothing to see",
+	})
+
+	estimate, ok := EstimateHits(pages, "whale", SearchOptions{})
+	if !ok || estimate.Hits != 2 || estimate.Method != ESTIMATE_SAMPLE {
+		t.Fatalf("unexpected estimate: %+v, %v", estimate, ok)
+	}
+
+	estimate, ok = EstimateHits(pages, "whale", SearchOptions{Index: BuildIndex(pages), PerPageLimit: 1})
+	if !ok || estimate.Hits != 1 || !estimate.Exact() {
+		t.Fatalf("unexpected estimate with the index: %+v, %v", estimate, ok)
+	}
+
+	// Too big to search in full, so the estimate is from a sample.
+	const repeats = 20000
+	sentence := "the whale and the narwhale swam "
+	big := makeTestPages(map[string]string{
+		"a": strings.Repeat(sentence, repeats),
+		"b": strings.Repeat(sentence, repeats),
+		"c": strings.Repeat("nothing to see ", repeats),
+	})
+	estimate, ok = EstimateHits(big, "whale", SearchOptions{})
+	expected := 2 * repeats
+	if !ok || estimate.Hits < expected*3/4 || estimate.Hits > expected*5/4 || estimate.Exact() {
+		t.Fatalf("unexpected estimate for %d hit(s): %+v, %v", expected, estimate, ok)
+	}
+
+	count, partial := CountMatches(pages, "whale", 0, make(chan struct{}), 0)
+	if count != 2 || partial {
+		t.Fatalf("unexpected count: %d, %v", count, partial)
+	}
+	count, _ = CountMatches(pages, "whale", 1, make(chan struct{}), 0)
+	if count != 1 {
+		t.Fatalf("unexpected count with a limit of 1 per page: %d", count)
+	}
+
+	unloaded := Pages{Pages: []Page{{FileName: "a", FilePath: "a/merged.txt"}}}
+	_, ok = EstimateHits(unloaded, "whale", SearchOptions{})
+	if ok {
+		t.Fatal("expected no estimate for pages without text")
+	}
+}
+
+func TestIndexFinder(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": "Whale whale whales whale-bone, the whale! Narwhale whale",
+		"b": "Café whale–whale",
+		"c": "nothing to see",
+	})
+
+	index := BuildIndex(pages)
+	path := t.TempDir() + "/" + INDEX_FILE_NAME
+	err := index.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err = LoadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if index.IsStale(pages) {
+		t.Fatal("index should not be stale")
+	}
+
+	for _, keyword := range []string{"whale", "Whale", "Caf", "whales", "missing"} {
+		expected := collectMatches(t, pages, keyword, SearchOptions{})
+		actual := collectMatches(t, pages, keyword, SearchOptions{Index: index})
+		if !slices.Equal(expected, actual) {
+			t.Fatalf("index results for '%s' differ from full scan: %v != %v", keyword, actual, expected)
+		}
+
+		for _, limit := range []int{0, 1} {
+			n := len(collectMatches(t, pages, keyword, SearchOptions{PerPageLimit: limit}))
+			if index.CountHits(keyword, limit) != n {
+				t.Fatalf("wrong hit count for '%s' with limit %d: %d != %d", keyword, limit, index.CountHits(keyword, limit), n)
+			}
+		}
+	}
+
+	pages.Pages[0].Text += " whale"
+	if !index.IsStale(pages) {
+		t.Fatal("index should be stale")
+	}
+}
+
+func TestIndexStaleLazyPages(t *testing.T) {
+	directory := writeTestCorpus(t, map[string]string{
+		"a": "the whale, the whale",
+		"b": "Café whale",
+	})
+
+	pages, err := LoadPages(directory, true, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := BuildIndex(pages)
+	if index.IsStale(pages) {
+		t.Fatal("index should not be stale")
+	}
+
+	// The same size, but different text: only the second "whale" is still where it was.
+	path := directory + "/a/merged.txt"
+	err = os.WriteFile(path, []byte("the sea, fish, whale"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.IsStale(pages) {
+		t.Fatal("index should be stale")
+	}
+
+	// Even with the stale index, only hits that are in the text are returned.
+	expected := collectMatches(t, pages, "whale", SearchOptions{})
+	actual := collectMatches(t, pages, "whale", SearchOptions{Index: index})
+	if len(expected) != 2 || !slices.Equal(expected, actual) {
+		t.Fatalf("stale index results differ from full scan: %v != %v", actual, expected)
+	}
+
+	err = os.WriteFile(path, []byte("whale"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual = collectMatches(t, pages, "whale", SearchOptions{Index: index})
+	if len(actual) != 1 || actual[0].FileName != "b" {
+		t.Fatalf("unexpected results for a shorter text: %v", actual)
+	}
+}
+
+func collectMatches(t *testing.T, pages Pages, keyword string, options SearchOptions) []Match {
+	t.Helper()
+
+	ch, _, err := StreamSearch(pages, keyword, make(chan struct{}), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches := []Match{}
+	for batch := range ch {
+		for _, match := range batch {
+			matches = append(matches, match)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].FileName != matches[j].FileName {
+			return matches[i].FileName < matches[j].FileName
+		}
+		return matches[i].Left < matches[j].Left
+	})
+	return matches
+}
+
+func TestBuildSuffixArray(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for iteration := 0; iteration < 1000; iteration++ {
+		text := make([]byte, rng.IntN(50))
+		for i := range text {
+			text[i] = byte('a' + rng.IntN(3))
+		}
+
+		expected := make([]int32, len(text))
+		for i := range expected {
+			expected[i] = int32(i)
+		}
+		sort.Slice(expected, func(i, j int) bool {
+			return string(text[expected[i]:]) < string(text[expected[j]:])
+		})
+
+		actual := buildSuffixArray(text)
+		if !slices.Equal(actual, expected) {
+			t.Fatalf("wrong suffix array for '%s': %v != %v", text, actual, expected)
+		}
+	}
+}
+
+func TestSimdFinder(t *testing.T) {
+	defer func(saved bool) { useSimd = saved }(useSimd)
+
+	rng := rand.New(rand.NewPCG(3, 4))
+	for _, simd := range []bool{useSimd, false} {
+		useSimd = simd
+		for iteration := 0; iteration < 2000; iteration++ {
+			text := make([]byte, rng.IntN(300))
+			for i := range text {
+				text[i] = "ab "[rng.IntN(3)]
+			}
+
+			// keywords taken from the text are likely to occur in it, including at the end
+			var keyword string
+			length := 1 + rng.IntN(40)
+			if len(text) > 0 && rng.IntN(2) == 0 {
+				start := rng.IntN(len(text))
+				keyword = string(text[start:min(start+length, len(text))])
+			} else {
+				keyword = strings.Repeat("a", length)
+			}
+
+			if indexSimd(string(text), keyword) != strings.Index(string(text), keyword) {
+				t.Fatalf("indexSimd('%s', '%s') is wrong (simd=%v)", text, keyword, simd)
+			}
+
+			page := Page{FileName: "a", Text: string(text)}
+			expected := findMatchesWith(t, page, keyword, func(keyword string) (IFinder, error) {
+				finder, err := NewFinder(keyword)
+				return &finder, err
+			})
+			actual := findMatchesWith(t, page, keyword, NewSimdFinder)
+			if !slices.Equal(expected, actual) {
+				t.Fatalf("results for '%s' in '%s' differ (simd=%v): %v != %v", keyword, text, simd, actual, expected)
+			}
+		}
+	}
+}
+
+func TestFinders(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": "Whale whale whales whale-bone, the whale! Narwhale whale",
+		"b": "Café whale–whale. whale whale whale",
+		"c": "the the the thethe",
+	})
+
+	suffixArrayPath := t.TempDir() + "/" + SUFFIX_ARRAY_FILE_NAME
+	err := WriteSuffixArray(pages, suffixArrayPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, err := LoadSuffixArray(suffixArrayPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sa.Close()
+	saPages := Pages{Pages: sa.Pages()}
+
+	for _, keyword := range []string{"whale", "the", "a whale", "whale whale", "e", "missing"} {
+		expected := collectMatches(t, pages, keyword, SearchOptions{Finder: "regexp"})
+		for _, name := range append(FinderNames(), FINDER_AUTO) {
+			options := SearchOptions{Finder: name, Index: BuildIndex(pages), SuffixArray: sa}
+			if name == "index" && !IsIndexable(keyword) {
+				_, _, err := StreamSearch(pages, keyword, make(chan struct{}), options)
+				if !errors.Is(err, ErrFinderUnavailable) {
+					t.Fatalf("expected the index finder to be unavailable for '%s'", keyword)
+				}
+				continue
+			}
+
+			searchPages := pages
+			if name == "suffix-array" {
+				searchPages = saPages
+			}
+			actual := collectMatches(t, searchPages, keyword, options)
+			if !slices.Equal(expected, actual) {
+				t.Fatalf("%s finder: results for '%s' differ: %v != %v", name, keyword, actual, expected)
+			}
+		}
+	}
+
+	if ChooseFinder("whale", pages, SearchOptions{Index: &Index{}}) != "index" {
+		t.Fatal("expected the index to be chosen")
+	}
+
+	// no 'z' in the corpus, so `strings.Index` can skip straight through it
+	if ChooseFinder("zebra crossing", pages, SearchOptions{}) != "strings" {
+		t.Fatal("expected the strings finder to be chosen for a rare first byte")
+	}
+
+	if IsFinderName("bogus") || !IsFinderName(FINDER_AUTO) || !IsFinderName("horspool") {
+		t.Fatal("IsFinderName is wrong")
+	}
+}
+
+func TestStreamSearchMulti(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	for iteration := 0; iteration < 500; iteration++ {
+		texts := make(map[string]string)
+		for _, fileName := range []string{"a", "b"} {
+			text := make([]byte, rng.IntN(200))
+			for i := range text {
+				text[i] = "ab "[rng.IntN(3)]
+			}
+			texts[fileName] = string(text)
+		}
+		pages := makeTestPages(texts)
+
+		keywords := []string{}
+		for i := 0; i < 1+rng.IntN(4); i++ {
+			keyword := make([]byte, 1+rng.IntN(5))
+			for j := range keyword {
+				keyword[j] = "ab "[rng.IntN(3)]
+			}
+			keywords = append(keywords, string(keyword))
+		}
+
+		// the same as searching for each keyword in turn
+		expected := []Match{}
+		seen := make(map[string]bool)
+		for _, keyword := range keywords {
+			if seen[keyword] {
+				continue
+			}
+			seen[keyword] = true
+
+			for _, match := range collectMatches(t, pages, keyword, SearchOptions{Finder: "regexp"}) {
+				match.Pattern = keyword
+				expected = append(expected, match)
+			}
+		}
+		sortMatchesFully(expected)
+
+		for _, chunkSize := range []int{-1, 7} {
+			ch, _, err := StreamSearchMulti(pages, keywords, make(chan struct{}), SearchOptions{ChunkSize: chunkSize})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := []Match{}
+			for batch := range ch {
+				for _, match := range batch {
+					actual = append(actual, match)
+				}
+			}
+			sortMatchesFully(actual)
+
+			if !slices.Equal(expected, actual) {
+				t.Fatalf("results for %q in %q differ (chunk size %d): %v != %v", keywords, texts, chunkSize, actual, expected)
+			}
+		}
+	}
+
+	_, _, err := StreamSearchMulti(Pages{}, []string{""}, make(chan struct{}), SearchOptions{})
+	if err == nil {
+		t.Fatal("expected an error for no keywords")
+	}
+}
+
+func sortMatchesFully(matches []Match) {
+	sort.Slice(matches, func(i, j int) bool {
+		a := matches[i]
+		b := matches[j]
+		if a.FileName != b.FileName {
+			return a.FileName < b.FileName
+		}
+		if a.Left != b.Left {
+			return a.Left < b.Left
+		}
+		if a.Right != b.Right {
+			return a.Right < b.Right
+		}
+		return a.Pattern < b.Pattern
+	})
+}
+
+func findMatchesWith(t *testing.T, page Page, keyword string, newFinder func(keyword string) (IFinder, error)) []Match {
+	t.Helper()
+
+	finder, err := newFinder(keyword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches := []Match{}
+	FindMatches(finder, page, 0, func(match Match) bool {
+		matches = append(matches, match)
+		return true
+	})
+	return matches
+}
+
+func TestSuffixArrayFinder(t *testing.T) {
+	pages := makeTestPages(map[string]string{
+		"a": "Whale whale whales whale-bone, the whale! Narwhale whale",
+		"b": "nothing",
+		"c": "Café whale–whale. whale whale whale",
+	})
+
+	path := t.TempDir() + "/" + SUFFIX_ARRAY_FILE_NAME
+	err := WriteSuffixArray(pages, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sa, err := LoadSuffixArray(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sa.Close()
+
+	if sa.Count("hale") != 12 || sa.Count("whale whale") != 4 || sa.Count("vampire") != 0 {
+		t.Fatal()
+	}
+
+	saPages := Pages{Pages: sa.Pages(), Manifest: pages.Manifest}
+	for _, keyword := range []string{"whale", "hale", "whale whale", "Café", "missing"} {
+		expected := collectMatches(t, pages, keyword, SearchOptions{})
+		actual := collectMatches(t, saPages, keyword, SearchOptions{SuffixArray: sa})
+		if !slices.Equal(expected, actual) {
+			t.Fatalf("suffix array results for '%s' differ from full scan: %v != %v", keyword, actual, expected)
+		}
+	}
+
+	// The pages are separated by NUL, but a keyword can't match across two of them.
+	if len(sa.PageOffsets("whale\x00nothing")) != 0 || len(collectMatches(t, saPages, "whale\x00nothing", SearchOptions{SuffixArray: sa})) != 0 {
+		t.Fatal("expected no hits across the end of a page")
+	}
+}
+
+func TestLoadPagesMmap(t *testing.T) {
+	directory := writeTestCorpus(t, map[string]string{
+		"a": "the whale, the whale",
+		"b": "Café whale",
+	})
+
+	pages, err := LoadPages(directory, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := collectMatches(t, pages, "whale", SearchOptions{})
+
+	for _, fileNamesOnly := range []bool{false, true} {
+		mmapPages, err := LoadPagesMmap(directory, fileNamesOnly, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the matches point into the mapped files, so compare them before closing
+		actual := collectMatches(t, mmapPages, "whale", SearchOptions{})
+		equal := slices.Equal(expected, actual)
+		mmapPages.Close()
+		if !equal {
+			t.Fatalf("mmap results differ (fileNamesOnly=%v)", fileNamesOnly)
+		}
+	}
+}
+
+func TestLoadPagesWhere(t *testing.T) {
+	directory := writeTestCorpus(t, map[string]string{
+		"a": "the whale, the whale",
+		"b": "Café whale",
+	})
+
+	for _, useMmap := range []bool{false, true} {
+		pages, err := LoadPagesWhere(directory, false, -1, useMmap, func(fileName string) bool { return fileName == "a" })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pages.Pages) != 1 || pages.Pages[0].FileName != "a" || pages.Pages[0].Text != "the whale, the whale" {
+			t.Fatalf("unexpected pages (useMmap=%v): %+v", useMmap, pages.Pages)
+		}
+		pages.Close()
+	}
+}
+
+func TestLoadPacked(t *testing.T) {
+	directory := writeTestCorpus(t, map[string]string{
+		"a": "the whale, the whale, the whale",
+		"b": "Café whale whales",
+		"c": "whale",
+	})
+
+	pages, err := LoadPages(directory, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := directory + "/" + PACKED_FILE_NAME
+	err = WritePacked(pages, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packedPages, err := LoadPacked(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packedPages.Close()
+
+	if len(packedPages.Pages) != 3 || packedPages.Pages[1].Text != "Café whale whales" {
+		t.Fatal("packed pages differ")
+	}
+
+	expected := collectMatches(t, pages, "whale", SearchOptions{})
+	actual := collectMatches(t, packedPages, "whale", SearchOptions{})
+	if !slices.Equal(expected, actual) {
+		t.Fatal("packed results differ")
+	}
+
+	// small chunks, so that hits straddle chunk boundaries
+	finder, err := NewFinder("whale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for chunkSize := 1; chunkSize <= 8; chunkSize++ {
+		for _, limit := range []int{0, 1} {
+			matches := []Match{}
+			stats := &SearchStats{Suppressed: make(map[string]int)}
+			options := SearchOptions{MaxGoroutines: 1, PerPageLimit: limit}
+			searchPacked(packedPages.packed, &finder, chunkOverlap("whale"), chunkSize, options, stats, nil, func(batch []Match) bool {
+				matches = append(matches, batch...)
+				return true
+			})
+
+			if limit == 0 && len(matches) != 5 {
+				t.Fatalf("chunk size %d: got %d match(es), expected 5", chunkSize, len(matches))
+			}
+			if limit == 1 && (len(matches) != 3 || stats.Suppressed["a"] != 2) {
+				t.Fatalf("chunk size %d: wrong per-page limit", chunkSize)
+			}
+		}
+	}
+
+	if !canOverlapItself("a a") || canOverlapItself("whale") {
+		t.Fatal("canOverlapItself is wrong")
+	}
+}
+
+func TestAddRemovePage(t *testing.T) {
+	directory := writeTestCorpus(t, map[string]string{
+		"a": "the whale, the whale",
+		"c": "a whale and a vampire",
+	})
+	manifest := `{"a": {"title": "A"}, "b": {"title": "B"}, "c": {"title": "C"}}`
+	err := os.WriteFile(directory+"/manifest.json", []byte(manifest), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := LoadPagesMmap(directory, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := BuildIndex(pages)
+
+	// a new book
+	err = os.Mkdir(directory+"/b", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(directory+"/b/merged.txt", []byte("whale whale vampire"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, err := AddPage(pages, index, directory, "b", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUpdate(t, added, directory, []string{"a", "b", "c"})
+	if len(pages.Pages) != 2 || len(collectMatches(t, pages, "whale", SearchOptions{Index: index})) != 3 {
+		t.Fatal("old pages changed")
+	}
+
+	// a changed book, written to a new file and renamed over the old one, since the old one
+	// is still mapped
+	err = os.WriteFile(directory+"/c/merged.txt.tmp", []byte("no more"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(directory+"/c/merged.txt.tmp", directory+"/c/merged.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaced, err := AddPage(added.Pages, added.Index, directory, "c", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUpdate(t, replaced, directory, []string{"a", "b", "c"})
+
+	removed, err := RemovePage(replaced.Pages, replaced.Index, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUpdate(t, removed, directory, []string{"b", "c"})
+	if _, ok := removed.Pages.Manifest["a"]; ok || !strings.Contains(string(removed.Pages.ManifestJson), `"title":"B"`) {
+		t.Fatalf("unexpected manifest: %s", removed.Pages.ManifestJson)
+	}
+
+	_, err = RemovePage(removed.Pages, removed.Index, "a")
+	if !errors.Is(err, ErrNoSuchPage) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = AddPage(removed.Pages, removed.Index, directory, "../a", true)
+	if err == nil {
+		t.Fatal()
+	}
+
+	added.Release()
+	replaced.Release()
+	removed.Release()
+	removed.Pages.Close()
+}
+
+// checkUpdate checks that `update` searches the same as loading `fileNames` from scratch.
+func checkUpdate(t *testing.T, update PagesUpdate, directory string, fileNames []string) {
+	t.Helper()
+
+	if len(update.Pages.Pages) != len(fileNames) {
+		t.Fatalf("expected %d page(s), got %d", len(fileNames), len(update.Pages.Pages))
+	}
+	for i, page := range update.Pages.Pages {
+		if page.FileName != fileNames[i] {
+			t.Fatalf("expected %s at %d, got %s", fileNames[i], i, page.FileName)
+		}
+	}
+
+	if update.Index.IsStale(update.Pages) {
+		t.Fatal("index should not be stale")
+	}
+
+	pages, err := LoadPages(directory, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, _ = FilterPages(pages, PageFilter{Files: fileNames})
+
+	for _, keyword := range []string{"whale", "vampire", "more"} {
+		expected := collectMatches(t, pages, keyword, SearchOptions{})
+		actual := collectMatches(t, update.Pages, keyword, SearchOptions{})
+		indexed := collectMatches(t, update.Pages, keyword, SearchOptions{Index: update.Index})
+		if !slices.Equal(expected, actual) || !slices.Equal(expected, indexed) {
+			t.Fatalf("results for '%s' differ: %v, %v != %v", keyword, actual, indexed, expected)
+		}
+	}
+}
+
+func TestLoadCompressed(t *testing.T) {
+	// long enough for several blocks, with hits on either side of the block boundaries
+	rng := rand.New(rand.NewPCG(5, 6))
+	words := []string{"the", "whale", "a", "vampire", "café", "whaler", "sea,"}
+	var long strings.Builder
+	for long.Len() < 3*COMPRESSED_BLOCK_SIZE {
+		long.WriteString(words[rng.IntN(len(words))] + " ")
+	}
+	directory := writeTestCorpus(t, map[string]string{
+		"a": long.String() + "Ishmael",
+		"b": "Café whale whales",
+		"c": "",
+	})
+
+	pages, err := LoadPages(directory, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := directory + "/" + COMPRESSED_FILE_NAME
+	err = WriteCompressed(pages, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressedPages, err := LoadCompressed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressedPages.Close()
+
+	for i, page := range compressedPages.Pages {
+		text, _, ok := loadPageText(page)
+		if !ok || text != pages.Pages[i].Text || page.WordCount != pages.Pages[i].WordCount {
+			t.Fatalf("text of %s differs", page.FileName)
+		}
+	}
+
+	// "whale whale" overlaps itself, and the last keyword is too long for the blocks' margins,
+	// so both are searched a page at a time
+	longKeyword := strings.Repeat("x", COMPRESSED_BLOCK_MARGIN)
+	for _, keyword := range []string{"whale", "café", "Ishmael", "whale whale", longKeyword} {
+		for _, perBook := range []int{0, 7} {
+			expected := collectMatches(t, pages, keyword, SearchOptions{PerPageLimit: perBook})
+			actual := collectMatches(t, compressedPages, keyword, SearchOptions{PerPageLimit: perBook})
+			if (perBook == 0 && !slices.Equal(expected, actual)) || len(expected) != len(actual) {
+				t.Fatalf("compressed results for '%s' differ: %d != %d", keyword, len(actual), len(expected))
+			}
+		}
+	}
+
+	ch, stats, err := StreamSearch(compressedPages, "Ishmael", make(chan struct{}), SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range ch {
+	}
+	if stats.Blocks != 5 || stats.SkippedBlocks != 3 {
+		t.Fatalf("skipped %d of %d block(s)", stats.SkippedBlocks, stats.Blocks)
+	}
+}
+
+func TestLoadCompressedCorrupt(t *testing.T) {
+	directory := writeTestCorpus(t, map[string]string{"a": "the whale, the whale"})
+	pages, err := LoadPages(directory, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := directory + "/" + COMPRESSED_FILE_NAME
+	err = WriteCompressed(pages, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Zero the block's signature length, padding with spaces so that the header keeps its
+	// length. The signature would otherwise have a mask of all ones and no words to index.
+	field := regexp.MustCompile(`"signature_words":\d+`)
+	location := field.FindIndex(data)
+	if location == nil {
+		t.Fatal("no signature_words in header")
+	}
+	replacement := `"signature_words":0` + strings.Repeat(" ", location[1]-location[0]-len(`"signature_words":0`))
+	copy(data[location[0]:], replacement)
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadCompressed(path)
+	if err == nil {
+		t.Fatal("loaded a file with an empty signature")
+	}
+}
+
+func TestPageCache(t *testing.T) {
+	directory := writeTestCorpus(t, map[string]string{
+		"a": "the whale, the whale",
+		"b": strings.Repeat("x", 100),
+		"c": "a whale and a vampire",
+	})
+
+	pages, err := LoadPages(directory, false, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := collectMatches(t, pages, "whale", SearchOptions{})
+
+	// too small for "b", which is read every time
+	cache := NewPageCache(50)
+	cachedPages, err := LoadPagesCached(directory, -1, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		actual := collectMatches(t, cachedPages, "whale", SearchOptions{MaxGoroutines: 1})
+		if !slices.Equal(expected, actual) {
+			t.Fatalf("cached results differ: %v != %v", actual, expected)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 4 || stats.Evictions != 0 || stats.Pages != 2 || stats.Bytes != 41 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// "a" is the least recently used, so it is evicted to make room
+	cache.put("d", strings.Repeat("y", 10), cache.generation)
+	stats = cache.Stats()
+	if stats.Evictions != 1 || stats.Pages != 2 || stats.Bytes != 31 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	cache.Forget("d")
+	if cache.Stats().Pages != 1 {
+		t.Fatal()
+	}
+
+	// text read before the page was forgotten, or the cache cleared, is stale
+	generation := cache.generation
+	cache.Forget("d")
+	cache.put("d", "old", generation)
+	generation = cache.generation
+	cache.Clear()
+	cache.put("e", "old", generation)
+	if cache.Stats().Pages != 0 {
+		t.Fatal("expected stale text to be left out of the cache")
+	}
+	cache.put("d", "new", cache.generation)
+	if cache.Stats().Pages != 1 {
+		t.Fatal("expected text read after the page was forgotten to be cached")
+	}
+}
+
+func writeTestCorpus(t *testing.T, texts map[string]string) string {
+	t.Helper()
+
+	directory := t.TempDir()
+	for fileName, text := range texts {
+		err := os.Mkdir(directory+"/"+fileName, 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(directory+"/"+fileName+"/merged.txt", []byte(text), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := os.WriteFile(directory+"/manifest.json", []byte("{}"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return directory
+}
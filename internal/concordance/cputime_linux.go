@@ -0,0 +1,21 @@
+//go:build linux
+
+package concordance
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// threadCpuTime returns the CPU time that the calling thread has used. The goroutine must be
+// locked to the thread (see `runtime.LockOSThread`) for the difference between two calls to
+// mean anything.
+func threadCpuTime() time.Duration {
+	var usage unix.Rusage
+	err := unix.Getrusage(unix.RUSAGE_THREAD, &usage)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package concordance
+
+import "time"
+
+// threadCpuTime isn't measured on platforms other than Linux, so `SearchStats.CpuTime` is 0.
+func threadCpuTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,157 @@
+package concordance
+
+// how `EstimateHits` arrived at its estimate
+const ESTIMATE_INDEX = "index"
+const ESTIMATE_SUFFIX_ARRAY = "suffix-array"
+const ESTIMATE_SAMPLE = "sample"
+
+// how much of the corpus `EstimateHits` searches when it has to sample: this many windows of
+// this many bytes, spread evenly through the text
+const ESTIMATE_SAMPLE_WINDOWS = 16
+const ESTIMATE_SAMPLE_WINDOW_BYTES = 64 * 1024
+
+type HitEstimate struct {
+	Hits   int
+	Method string
+}
+
+// Exact returns whether `Hits` is exactly the number of hits a search would find.
+func (estimate HitEstimate) Exact() bool {
+	return estimate.Method == ESTIMATE_INDEX
+}
+
+// EstimateHits estimates how many hits a search for `keyword` with `options` would find,
+// for much less than the search would cost. The index, if it can answer the query, gives
+// the exact number; the suffix array gives the number of occurrences including those in the
+// middle of words; and otherwise a sample of the text is searched and the count scaled up to
+// the size of the corpus.
+//
+// It returns false if none of these is possible, e.g. because the texts are only read when
+// they are searched.
+func EstimateHits(pages Pages, keyword string, options SearchOptions) (HitEstimate, bool) {
+	if options.Index != nil && IsIndexable(keyword) {
+		return HitEstimate{Hits: options.Index.CountHits(keyword, options.PerPageLimit), Method: ESTIMATE_INDEX}, true
+	}
+
+	var estimate HitEstimate
+	if options.SuffixArray != nil {
+		estimate = HitEstimate{Hits: options.SuffixArray.Count(keyword), Method: ESTIMATE_SUFFIX_ARRAY}
+	} else {
+		hits, ok := sampleHits(pages, keyword)
+		if !ok {
+			return HitEstimate{}, false
+		}
+		estimate = HitEstimate{Hits: hits, Method: ESTIMATE_SAMPLE}
+	}
+
+	if options.PerPageLimit > 0 {
+		estimate.Hits = min(estimate.Hits, options.PerPageLimit*len(pages.Pages))
+	}
+	return estimate, true
+}
+
+// sampleHits counts the hits for `keyword` in `ESTIMATE_SAMPLE_WINDOWS` windows spread evenly
+// through the pages' text, and scales the count up to the length of the text. Pages whose
+// text isn't loaded are left out.
+func sampleHits(pages Pages, keyword string) (int, bool) {
+	total := 0
+	for _, page := range pages.Pages {
+		total += len(page.Text)
+	}
+	if total == 0 {
+		return 0, false
+	}
+
+	finder := NewStringsFinder(keyword)
+	hits := 0
+	sampled := 0
+	countWindow := func(text string, start int, end int) {
+		finder.FindAll(Page{Text: text[start:end]}, func(matchStart int, matchEnd int) bool {
+			// The boundaries are checked against the whole text, so that a hit at the edge
+			// of the window isn't mistaken for one.
+			if isOnWordBoundaries(text, start+matchStart, start+matchEnd) {
+				hits += 1
+			}
+			return true
+		})
+		sampled += end - start
+	}
+
+	if total <= ESTIMATE_SAMPLE_WINDOWS*ESTIMATE_SAMPLE_WINDOW_BYTES {
+		// The whole corpus costs no more to search than the sample would.
+		for _, page := range pages.Pages {
+			countWindow(page.Text, 0, len(page.Text))
+		}
+		return hits, true
+	}
+
+	// the offset of `pages.Pages[i]` in the text of all the pages put together
+	pageStart := 0
+	i := 0
+	// the end of the last window, if it was in `pages.Pages[i]`, so that windows in short
+	// pages don't overlap
+	lastEnd := 0
+	for w := 0; w < ESTIMATE_SAMPLE_WINDOWS; w++ {
+		center := total/ESTIMATE_SAMPLE_WINDOWS*w + total/ESTIMATE_SAMPLE_WINDOWS/2
+		for pageStart+len(pages.Pages[i].Text) <= center {
+			pageStart += len(pages.Pages[i].Text)
+			i += 1
+			lastEnd = 0
+		}
+
+		text := pages.Pages[i].Text
+		start := max(center-pageStart-ESTIMATE_SAMPLE_WINDOW_BYTES/2, lastEnd, 0)
+		end := min(start+ESTIMATE_SAMPLE_WINDOW_BYTES, len(text))
+		if start >= end {
+			continue
+		}
+		countWindow(text, start, end)
+		lastEnd = end
+	}
+
+	return int(int64(hits) * int64(total) / int64(sampled)), true
+}
+
+// CountMatches returns the number of hits for `keyword`, counting at most `perPageLimit` in
+// each page (0 for no limit), like a search that only counts its matches rather than
+// building them. It also returns true if `quitChannel` was closed before every page had been
+// searched, in which case the count is of the hits found so far.
+func CountMatches(pages Pages, keyword string, perPageLimit int, quitChannel chan struct{}, maxGoroutines int) (int, bool) {
+	quit := func() bool {
+		select {
+		case <-quitChannel:
+			return true
+		default:
+			return false
+		}
+	}
+
+	counts := make([]int, len(pages.Pages))
+	forEachPage(pages.Pages, maxGoroutines, func(i int, page Page) {
+		if quit() {
+			return
+		}
+
+		text, release, ok := loadPageText(page)
+		if !ok {
+			return
+		}
+		if release != nil {
+			defer release()
+		}
+
+		finder := NewStringsFinder(keyword)
+		finder.FindAll(Page{Text: text}, func(start int, end int) bool {
+			if isOnWordBoundaries(text, start, end) {
+				counts[i] += 1
+			}
+			return (perPageLimit == 0 || counts[i] < perPageLimit) && !quit()
+		})
+	})
+
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return total, quit()
+}
@@ -0,0 +1,58 @@
+package concordance
+
+import "strings"
+
+// PageFilter selects pages by author or by file name. A page is selected if it matches
+// any of the authors or any of the files. An empty filter selects nothing.
+type PageFilter struct {
+	Authors []string
+	Files   []string
+}
+
+func (filter PageFilter) IsEmpty() bool {
+	return len(filter.Authors) == 0 && len(filter.Files) == 0
+}
+
+func (filter PageFilter) Matches(page Page, manifest Manifest) bool {
+	for _, file := range filter.Files {
+		if page.FileName == file {
+			return true
+		}
+	}
+
+	author := manifest[page.FileName].Author
+	for _, filterAuthor := range filter.Authors {
+		if strings.EqualFold(author, filterAuthor) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FilterPages returns the pages that match `filter` and, separately, the pages that don't.
+func FilterPages(pages Pages, filter PageFilter) (Pages, Pages) {
+	matching := Pages{Pages: []Page{}, Manifest: pages.Manifest, ManifestJson: pages.ManifestJson}
+	rest := Pages{Pages: []Page{}, Manifest: pages.Manifest, ManifestJson: pages.ManifestJson}
+	for _, page := range pages.Pages {
+		if filter.Matches(page, pages.Manifest) {
+			matching.Pages = append(matching.Pages, page)
+		} else {
+			rest.Pages = append(rest.Pages, page)
+		}
+	}
+	return matching, rest
+}
+
+// SelectPages returns the pages for which `keep` returns true. Unlike `FilterPages`, the
+// result still owns the memory-mapped files of `pages`, so that closing it unmaps them.
+func SelectPages(pages Pages, keep func(page Page) bool) Pages {
+	selected := pages
+	selected.Pages = []Page{}
+	for _, page := range pages.Pages {
+		if keep(page) {
+			selected.Pages = append(selected.Pages, page)
+		}
+	}
+	return selected
+}
@@ -2,7 +2,6 @@ package concordance
 
 import (
 	"log"
-	"os"
 	"regexp"
 )
 
@@ -12,7 +11,7 @@ type Finder struct {
 
 func NewFinder(keyword string) (Finder, error) {
 	// The '\b' word boundary regex pattern is very slow. So we don't use it here and
-	// instead filter for word boundaries inside `findConcordance`.
+	// instead filter for word boundaries inside `FindMatches`.
 	// TODO: case-insensitive matching - (?i) flag (but it's slow)
 	pattern := regexp.QuoteMeta(keyword)
 	rgx, err := regexp.Compile(pattern)
@@ -23,47 +22,22 @@ func NewFinder(keyword string) (Finder, error) {
 	return Finder{rgx: rgx}, err
 }
 
-func (fdr *Finder) Find(page Page, outChannel chan Match, quitChannel chan struct{}) {
-	var text string
-	if len(page.Text) == 0 {
-		bytes, err := os.ReadFile(page.FilePath)
-		if err != nil {
-			log.Printf("failed to read file: %s (%s)", page.FilePath, err)
+func (fdr *Finder) FindAll(page Page, yield func(start int, end int) bool) {
+	// Unlike `FindAllStringIndex`, this doesn't scan the rest of the page if `yield` stops
+	// early.
+	text := page.Text
+	offset := 0
+	for offset < len(text) {
+		pair := fdr.rgx.FindStringIndex(text[offset:])
+		if pair == nil {
 			return
 		}
-		text = string(bytes)
-	} else {
-		text = page.Text
-	}
-
-	indices := fdr.rgx.FindAllStringSubmatchIndex(text, -1)
-
-	for _, pair := range indices {
-		start := pair[0]
-		end := pair[1]
-		leftStart := max(0, start-CONTEXT_LENGTH)
-		rightEnd := min(end+CONTEXT_LENGTH, len(text))
-
-		// TODO: this doesn't work with Unicode
-		if start > 0 && isLetter(text[start-1]) {
-			continue
-		}
-
-		if end < len(text) && isLetter(text[end]) {
-			continue
-		}
-
-		match := Match{
-			FileName: page.FileName,
-			Left:     SliceLeftUtf8(text, start, leftStart),
-			Right:    SliceRightUtf8(text, end, rightEnd),
-		}
 
-		select {
-		case outChannel <- match:
-			continue
-		case <-quitChannel:
+		start := offset + pair[0]
+		end := offset + pair[1]
+		if !yield(start, end) {
 			return
 		}
+		offset = end
 	}
 }
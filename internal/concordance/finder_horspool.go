@@ -0,0 +1,43 @@
+package concordance
+
+// HorspoolFinder finds the keyword with the Boyer–Moore–Horspool algorithm, which compares
+// the last byte of the keyword first and, on a mismatch, skips ahead by up to the length of
+// the keyword.
+type HorspoolFinder struct {
+	keyword string
+	// how far to move forward when the byte under the end of the keyword is `b`
+	shift [256]int
+}
+
+func NewHorspoolFinder(keyword string) HorspoolFinder {
+	fdr := HorspoolFinder{keyword: keyword}
+	for i := range fdr.shift {
+		fdr.shift[i] = len(keyword)
+	}
+	for i := 0; i < len(keyword)-1; i++ {
+		fdr.shift[keyword[i]] = len(keyword) - 1 - i
+	}
+	return fdr
+}
+
+func (fdr *HorspoolFinder) FindAll(page Page, yield func(start int, end int) bool) {
+	n := len(fdr.keyword)
+	if n == 0 {
+		return
+	}
+
+	text := page.Text
+	last := fdr.keyword[n-1]
+	i := 0
+	for i+n <= len(text) {
+		b := text[i+n-1]
+		if b == last && text[i:i+n-1] == fdr.keyword[:n-1] {
+			if !yield(i, i+n) {
+				return
+			}
+			i += n
+		} else {
+			i += fdr.shift[b]
+		}
+	}
+}
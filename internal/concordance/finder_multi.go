@@ -0,0 +1,179 @@
+package concordance
+
+import "errors"
+
+// IMultiFinder is an `IFinder` that looks for several keywords at once. Each keyword's
+// occurrences don't overlap each other, but they may overlap other keywords', so the hits
+// are the same as searching for each keyword in turn.
+type IMultiFinder interface {
+	IFinder
+	// KeywordAt returns the keyword that was found at `text[start:end]`.
+	KeywordAt(text string, start int, end int) string
+}
+
+// AhoCorasickFinder finds any of a set of keywords in a single pass over the text, using
+// the Aho–Corasick automaton of the keywords.
+type AhoCorasickFinder struct {
+	keywords []string
+	// Bytes that don't occur in any keyword all behave the same, so the automaton works on
+	// classes of bytes instead, to keep its table small enough for the CPU cache: byte `b` is
+	// in class `classes[b]`, and there are `numClasses` of them.
+	classes    [256]int32
+	numClasses int32
+	// the automaton's transitions: from state `s` on class `c` to `delta[s*numClasses+c]`,
+	// or to `^delta[s*numClasses+c]` if that is negative, which marks a state with outputs
+	delta []int32
+	// the keywords (as indices into `keywords`) that end at each state
+	outputs   [][]int32
+	maxLength int
+	indices   map[string]int
+}
+
+type acHit struct {
+	start int
+	end   int
+}
+
+// NewAhoCorasickFinder returns a finder for `keywords`, ignoring empty and duplicate ones.
+func NewAhoCorasickFinder(keywords []string) (AhoCorasickFinder, error) {
+	fdr := AhoCorasickFinder{indices: make(map[string]int), numClasses: 1}
+	for _, keyword := range keywords {
+		if _, ok := fdr.indices[keyword]; ok || keyword == "" {
+			continue
+		}
+		fdr.indices[keyword] = len(fdr.keywords)
+		fdr.keywords = append(fdr.keywords, keyword)
+		fdr.maxLength = max(fdr.maxLength, len(keyword))
+
+		for i := 0; i < len(keyword); i++ {
+			if fdr.classes[keyword[i]] == 0 {
+				fdr.classes[keyword[i]] = fdr.numClasses
+				fdr.numClasses += 1
+			}
+		}
+	}
+
+	if len(fdr.keywords) == 0 {
+		return AhoCorasickFinder{}, errors.New("no keywords to search for")
+	}
+
+	// the trie of the keywords, with -1 for missing edges
+	k := int(fdr.numClasses)
+	newState := func() int32 {
+		fdr.outputs = append(fdr.outputs, nil)
+		for c := 0; c < k; c++ {
+			fdr.delta = append(fdr.delta, -1)
+		}
+		return int32(len(fdr.outputs) - 1)
+	}
+	newState()
+	for i, keyword := range fdr.keywords {
+		state := int32(0)
+		for j := 0; j < len(keyword); j++ {
+			edge := int(state)*k + int(fdr.classes[keyword[j]])
+			if fdr.delta[edge] == -1 {
+				fdr.delta[edge] = newState()
+			}
+			state = fdr.delta[edge]
+		}
+		fdr.outputs[state] = append(fdr.outputs[state], int32(i))
+	}
+
+	// Turn the trie into a complete automaton, breadth first so that each state's failure
+	// state (the longest proper suffix of it that is in the trie) is finished before it.
+	fail := make([]int32, len(fdr.outputs))
+	queue := []int32{}
+	for c := 0; c < k; c++ {
+		next := fdr.delta[c]
+		if next == -1 {
+			fdr.delta[c] = 0
+		} else {
+			queue = append(queue, next)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		fdr.outputs[state] = append(fdr.outputs[state], fdr.outputs[fail[state]]...)
+		for c := 0; c < k; c++ {
+			next := fdr.delta[int(state)*k+c]
+			onFail := fdr.delta[int(fail[state])*k+c]
+			if next == -1 {
+				fdr.delta[int(state)*k+c] = onFail
+			} else {
+				fail[next] = onFail
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	// Mark the transitions into states with outputs, so that `FindAll` only has to look at
+	// `outputs` when there is something there.
+	for i, next := range fdr.delta {
+		if len(fdr.outputs[next]) > 0 {
+			fdr.delta[i] = ^next
+		}
+	}
+
+	return fdr, nil
+}
+
+func (fdr *AhoCorasickFinder) KeywordAt(text string, start int, end int) string {
+	return fdr.keywords[fdr.indices[text[start:end]]]
+}
+
+func (fdr *AhoCorasickFinder) FindAll(page Page, yield func(start int, end int) bool) {
+	text := page.Text
+	lastEnd := make([]int, len(fdr.keywords))
+
+	// The automaton finds hits at their end, but they have to be yielded in order of their
+	// start, so they are held back until no hit found later could start before them.
+	pending := []acHit{}
+	flush := func(before int) bool {
+		n := 0
+		for n < len(pending) && pending[n].start < before {
+			if !yield(pending[n].start, pending[n].end) {
+				return false
+			}
+			n += 1
+		}
+		pending = pending[n:]
+		return true
+	}
+
+	delta := fdr.delta
+	classes := &fdr.classes
+	k := fdr.numClasses
+	state := int32(0)
+	for i := 0; i < len(text); i++ {
+		state = delta[state*k+classes[text[i]]]
+		if state >= 0 {
+			continue
+		}
+
+		state = ^state
+		for _, k := range fdr.outputs[state] {
+			end := i + 1
+			start := end - len(fdr.keywords[k])
+			if start < lastEnd[k] {
+				continue
+			}
+			lastEnd[k] = end
+
+			hit := acHit{start: start, end: end}
+			j := len(pending)
+			pending = append(pending, hit)
+			for j > 0 && (pending[j-1].start > start || (pending[j-1].start == start && pending[j-1].end > end)) {
+				pending[j] = pending[j-1]
+				j -= 1
+			}
+			pending[j] = hit
+		}
+
+		// a hit found later ends after `i`, so it starts after `i - maxLength + 1`
+		if len(pending) > 0 && !flush(i-fdr.maxLength+2) {
+			return
+		}
+	}
+	flush(len(text) + 1)
+}
@@ -0,0 +1,33 @@
+package concordance
+
+// OffsetFinder finds a keyword by looking up its offsets ahead of time, in an `Index` or a
+// `SuffixArray`, instead of scanning the text.
+type OffsetFinder struct {
+	keyword string
+	offsets map[string][]uint32
+}
+
+// NewIndexFinder only works for keywords for which `IsIndexable` is true.
+func NewIndexFinder(index *Index, keyword string) OffsetFinder {
+	return OffsetFinder{keyword: keyword, offsets: index.PageOffsets(keyword)}
+}
+
+// NewSuffixArrayFinder only works for pages that came from `sa.Pages()`.
+func NewSuffixArrayFinder(sa *SuffixArray, keyword string) OffsetFinder {
+	return OffsetFinder{keyword: keyword, offsets: sa.PageOffsets(keyword)}
+}
+
+func (fdr *OffsetFinder) FindAll(page Page, yield func(start int, end int) bool) {
+	for _, offset := range fdr.offsets[page.FileName] {
+		start := int(offset)
+		end := start + len(fdr.keyword)
+		// The offsets are only right for the text they were looked up in, and the page may
+		// have changed since (see `Index.IsStale`).
+		if end > len(page.Text) || page.Text[start:end] != fdr.keyword {
+			continue
+		}
+		if !yield(start, end) {
+			return
+		}
+	}
+}
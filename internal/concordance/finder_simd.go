@@ -0,0 +1,41 @@
+package concordance
+
+// SimdFinder finds the keyword with vector instructions where the CPU supports them (see
+// `HasSimd`). Its results are the same as `Finder`'s.
+type SimdFinder struct {
+	keyword string
+}
+
+// NewSimdFinder returns a `SimdFinder`, or, if the CPU doesn't support it, a `Finder`.
+func NewSimdFinder(keyword string) (IFinder, error) {
+	if !HasSimd() {
+		finder, err := NewFinder(keyword)
+		if err != nil {
+			return nil, err
+		}
+		return &finder, nil
+	}
+	return &SimdFinder{keyword: keyword}, nil
+}
+
+func (fdr *SimdFinder) FindAll(page Page, yield func(start int, end int) bool) {
+	if len(fdr.keyword) == 0 {
+		return
+	}
+
+	text := page.Text
+	offset := 0
+	for offset < len(text) {
+		i := indexSimd(text[offset:], fdr.keyword)
+		if i == -1 {
+			return
+		}
+
+		start := offset + i
+		end := start + len(fdr.keyword)
+		if !yield(start, end) {
+			return
+		}
+		offset = end
+	}
+}
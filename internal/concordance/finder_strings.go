@@ -0,0 +1,34 @@
+package concordance
+
+import "strings"
+
+// StringsFinder finds the keyword with `strings.Index`.
+type StringsFinder struct {
+	keyword string
+}
+
+func NewStringsFinder(keyword string) StringsFinder {
+	return StringsFinder{keyword: keyword}
+}
+
+func (fdr *StringsFinder) FindAll(page Page, yield func(start int, end int) bool) {
+	if len(fdr.keyword) == 0 {
+		return
+	}
+
+	text := page.Text
+	offset := 0
+	for offset < len(text) {
+		i := strings.Index(text[offset:], fdr.keyword)
+		if i == -1 {
+			return
+		}
+
+		start := offset + i
+		end := start + len(fdr.keyword)
+		if !yield(start, end) {
+			return
+		}
+		offset = end
+	}
+}
@@ -0,0 +1,151 @@
+package concordance
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// FINDER_AUTO picks a finder for each query with `ChooseFinder`.
+const FINDER_AUTO = "auto"
+
+// keywords at least this long are searched with `HorspoolFinder` if SIMD isn't available,
+// since its skips grow with the length of the keyword
+const HORSPOOL_MIN_LENGTH = 8
+
+// a byte that makes up less than this fraction of the corpus is rare enough that
+// `strings.Index` can skip from one occurrence of it to the next faster than any other finder
+const RARE_BYTE_FREQUENCY = 0.005
+
+// how much of the corpus `byteFrequency` looks at
+const BYTE_FREQUENCY_SAMPLE_PAGES = 64
+const BYTE_FREQUENCY_SAMPLE_BYTES = 4096
+
+// ErrFinderUnavailable is returned for a finder that can't answer the query, e.g. "index"
+// without an index.
+var ErrFinderUnavailable = errors.New("finder unavailable")
+
+// finders maps each finder's name to its constructor.
+var finders = map[string]func(keyword string, options SearchOptions) (IFinder, error){
+	"regexp": func(keyword string, options SearchOptions) (IFinder, error) {
+		finder, err := NewFinder(keyword)
+		if err != nil {
+			return nil, err
+		}
+		return &finder, nil
+	},
+	"strings": func(keyword string, options SearchOptions) (IFinder, error) {
+		finder := NewStringsFinder(keyword)
+		return &finder, nil
+	},
+	"horspool": func(keyword string, options SearchOptions) (IFinder, error) {
+		finder := NewHorspoolFinder(keyword)
+		return &finder, nil
+	},
+	"simd": func(keyword string, options SearchOptions) (IFinder, error) {
+		return NewSimdFinder(keyword)
+	},
+	"index": func(keyword string, options SearchOptions) (IFinder, error) {
+		if options.Index == nil {
+			return nil, fmt.Errorf("%w: no index is loaded", ErrFinderUnavailable)
+		}
+		if !IsIndexable(keyword) {
+			return nil, fmt.Errorf("%w: the index can only answer queries for a single word", ErrFinderUnavailable)
+		}
+		finder := NewIndexFinder(options.Index, keyword)
+		return &finder, nil
+	},
+	"suffix-array": func(keyword string, options SearchOptions) (IFinder, error) {
+		if options.SuffixArray == nil {
+			return nil, fmt.Errorf("%w: no suffix array is loaded", ErrFinderUnavailable)
+		}
+		finder := NewSuffixArrayFinder(options.SuffixArray, keyword)
+		return &finder, nil
+	},
+}
+
+// FinderNames returns the names that `NewFinderByName` accepts, in alphabetical order, not
+// including `FINDER_AUTO`.
+func FinderNames() []string {
+	names := make([]string, 0, len(finders))
+	for name := range finders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func IsFinderName(name string) bool {
+	_, ok := finders[name]
+	return ok || name == FINDER_AUTO
+}
+
+// NewFinderByName returns the finder called `name` (one of `FinderNames()`, or `FINDER_AUTO`)
+// for `keyword`.
+func NewFinderByName(name string, keyword string, pages Pages, options SearchOptions) (IFinder, error) {
+	if name == FINDER_AUTO {
+		name = ChooseFinder(keyword, pages, options)
+	}
+
+	newFinder, ok := finders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown finder: %q", name)
+	}
+	return newFinder(keyword, options)
+}
+
+// ChooseFinder returns the name of the finder that is likely to be fastest for `keyword`.
+func ChooseFinder(keyword string, pages Pages, options SearchOptions) string {
+	if options.Index != nil && IsIndexable(keyword) {
+		return "index"
+	}
+
+	if options.SuffixArray != nil {
+		return "suffix-array"
+	}
+
+	// `strings.Index` jumps between occurrences of the keyword's first byte with a
+	// vectorised loop, which nothing beats if there are few of them.
+	if len(keyword) <= 1 || byteFrequency(pages, keyword[0]) < RARE_BYTE_FREQUENCY {
+		return "strings"
+	}
+
+	if HasSimd() {
+		return "simd"
+	}
+
+	if len(keyword) >= HORSPOOL_MIN_LENGTH {
+		return "horspool"
+	}
+	return "strings"
+}
+
+// byteFrequency estimates the fraction of the bytes in the corpus that are `b`, from the
+// beginning of some of the pages. It returns 1 if none of the pages' text is loaded.
+func byteFrequency(pages Pages, b byte) float64 {
+	count := 0
+	total := 0
+	sampled := 0
+	for _, page := range pages.Pages {
+		if sampled == BYTE_FREQUENCY_SAMPLE_PAGES {
+			break
+		}
+		if len(page.Text) == 0 {
+			continue
+		}
+
+		sample := page.Text[:min(len(page.Text), BYTE_FREQUENCY_SAMPLE_BYTES)]
+		for i := 0; i < len(sample); i++ {
+			if sample[i] == b {
+				count += 1
+			}
+		}
+		total += len(sample)
+		sampled += 1
+	}
+
+	if total == 0 {
+		return 1
+	}
+	return float64(count) / float64(total)
+}
@@ -0,0 +1,391 @@
+package concordance
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// bump this whenever the serialised format or the tokenization changes
+const INDEX_VERSION = 2
+const INDEX_FILE_NAME = "index.gob"
+
+// Index is a positional inverted index of a set of pages: for each word, the pages it
+// occurs in and its offsets in each.
+//
+// Words are maximal runs of ASCII letters, case-sensitive. That is exactly how `FindMatches`
+// draws word boundaries, so for a keyword made only of letters, the index's hits are the
+// same as a full scan's.
+type Index struct {
+	Version int
+	// "" for a page that has been removed (see `WithoutPage`)
+	FileNames []string
+	// what each page's text was when it was indexed, to detect when the index is stale
+	Stamps   []PageStamp
+	Postings map[string]*PostingList
+}
+
+// PageStamp identifies the version of a page's text that was indexed.
+type PageStamp struct {
+	Size int
+	// the modification time of the page's file, in nanoseconds since the epoch, or 0 if it
+	// didn't have one (e.g. in a packed corpus)
+	ModTime int64
+	// CRC-32C of the text
+	Checksum uint32
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func newPageStamp(page Page, text string) PageStamp {
+	stamp := PageStamp{Size: len(text), Checksum: crc32.Checksum(unsafe.Slice(unsafe.StringData(text), len(text)), castagnoli)}
+	if page.FilePath != "" {
+		info, err := os.Stat(page.FilePath)
+		if err == nil && info.Size() == int64(len(text)) {
+			stamp.ModTime = info.ModTime().UnixNano()
+		}
+	}
+	return stamp
+}
+
+// matches returns whether `page` has the text that the stamp was made from. If the page's
+// file has the same size and modification time, it is assumed to; otherwise, its text is
+// read and compared with the checksum.
+func (stamp PageStamp) matches(page Page) bool {
+	if page.FilePath != "" && stamp.ModTime != 0 {
+		info, err := os.Stat(page.FilePath)
+		if err == nil && info.Size() == int64(stamp.Size) && info.ModTime().UnixNano() == stamp.ModTime {
+			return true
+		}
+	}
+
+	text, release, ok := loadPageText(page)
+	if !ok {
+		return false
+	}
+	if release != nil {
+		defer release()
+	}
+	return newPageStamp(Page{}, text) == PageStamp{Size: stamp.Size, Checksum: stamp.Checksum}
+}
+
+type PostingList struct {
+	// indices into `Index.FileNames`, in increasing order
+	Pages []uint32
+	// the offsets in `Pages[i]` are `Offsets[Ends[i-1]:Ends[i]]`
+	Ends    []uint32
+	Offsets []uint32
+}
+
+// IsIndexable returns whether the index can answer queries for `keyword`.
+func IsIndexable(keyword string) bool {
+	if len(keyword) == 0 {
+		return false
+	}
+
+	for i := 0; i < len(keyword); i++ {
+		if !isLetter(keyword[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func BuildIndex(pages Pages) *Index {
+	startTime := time.Now()
+	index := &Index{
+		Version:   INDEX_VERSION,
+		FileNames: make([]string, len(pages.Pages)),
+		Stamps:    make([]PageStamp, len(pages.Pages)),
+		Postings:  make(map[string]*PostingList),
+	}
+
+	// Pages are tokenized in parallel, a batch at a time, and then merged in order so that
+	// each posting list stays sorted by page without holding every page's words in memory
+	// at once.
+	batchSize := runtime.NumCPU() * 4
+	for batchStart := 0; batchStart < len(pages.Pages); batchStart += batchSize {
+		batch := pages.Pages[batchStart:min(batchStart+batchSize, len(pages.Pages))]
+		pageWords := make([]map[string][]uint32, len(batch))
+
+		forEachPage(batch, 0, func(i int, page Page) {
+			text, release, ok := loadPageText(page)
+			if !ok {
+				return
+			}
+			if release != nil {
+				defer release()
+			}
+			index.Stamps[batchStart+i] = newPageStamp(page, text)
+			pageWords[i] = indexPage(text, release != nil)
+		})
+
+		for i, words := range pageWords {
+			pageIndex := uint32(batchStart + i)
+			index.FileNames[pageIndex] = batch[i].FileName
+			for word, offsets := range words {
+				postings, ok := index.Postings[word]
+				if !ok {
+					postings = &PostingList{}
+					index.Postings[word] = postings
+				}
+				postings.Pages = append(postings.Pages, pageIndex)
+				postings.Offsets = append(postings.Offsets, offsets...)
+				postings.Ends = append(postings.Ends, uint32(len(postings.Offsets)))
+			}
+		}
+	}
+
+	durationMs := time.Since(startTime).Milliseconds()
+	log.Printf("built index of %d word(s) in %d ms", len(index.Postings), durationMs)
+	return index
+}
+
+// If `clone` is true, the words are copied rather than pointing into `text`.
+func indexPage(text string, clone bool) map[string][]uint32 {
+	words := make(map[string][]uint32)
+	i := 0
+	for i < len(text) {
+		if !isLetter(text[i]) {
+			i += 1
+			continue
+		}
+
+		start := i
+		for i < len(text) && isLetter(text[i]) {
+			i += 1
+		}
+		word := text[start:i]
+		offsets, ok := words[word]
+		if !ok && clone {
+			word = strings.Clone(word)
+		}
+		words[word] = append(offsets, uint32(start))
+	}
+	return words
+}
+
+// PageOffsets returns the offsets of `word` in each page that it occurs in, by file name.
+func (index *Index) PageOffsets(word string) map[string][]uint32 {
+	r := make(map[string][]uint32)
+	postings, ok := index.Postings[word]
+	if !ok {
+		return r
+	}
+
+	start := uint32(0)
+	for i, pageIndex := range postings.Pages {
+		end := postings.Ends[i]
+		r[index.FileNames[pageIndex]] = postings.Offsets[start:end]
+		start = end
+	}
+	return r
+}
+
+// CountHits returns the number of hits for `word` without looking them up, counting at most
+// `perPageLimit` in each page (0 for no limit).
+func (index *Index) CountHits(word string, perPageLimit int) int {
+	postings, ok := index.Postings[word]
+	if !ok {
+		return 0
+	}
+
+	if perPageLimit == 0 {
+		return len(postings.Offsets)
+	}
+
+	n := 0
+	start := uint32(0)
+	for _, end := range postings.Ends {
+		n += min(int(end-start), perPageLimit)
+		start = end
+	}
+	return n
+}
+
+// IsStale returns whether the index was built from a different set of pages.
+func (index *Index) IsStale(pages Pages) bool {
+	if index.Version != INDEX_VERSION {
+		return true
+	}
+
+	// Pages that were added after the index was built are at the end of it, so the pages are
+	// compared by name rather than in order.
+	stamps := make(map[string]PageStamp, len(index.FileNames))
+	for i, fileName := range index.FileNames {
+		if fileName != "" {
+			stamps[fileName] = index.Stamps[i]
+		}
+	}
+	if len(stamps) != len(pages.Pages) {
+		return true
+	}
+
+	for _, page := range pages.Pages {
+		if _, ok := stamps[page.FileName]; !ok {
+			return true
+		}
+	}
+
+	var stale atomic.Bool
+	forEachPage(pages.Pages, 0, func(i int, page Page) {
+		if !stale.Load() && !stamps[page.FileName].matches(page) {
+			stale.Store(true)
+		}
+	})
+	return stale.Load()
+}
+
+// WithPage returns a copy of the index with `page` added to it, replacing any page with the
+// same name. The copy shares the posting lists of words that aren't in the page, so neither
+// index may be modified afterwards.
+func (index *Index) WithPage(page Page) (*Index, error) {
+	text, release, ok := loadPageText(page)
+	if !ok {
+		return nil, fmt.Errorf("could not read text of %s", page.FileName)
+	}
+	if release != nil {
+		defer release()
+	}
+
+	r := index.WithoutPage(page.FileName)
+	pageIndex := uint32(len(r.FileNames))
+	r.FileNames = append(r.FileNames, page.FileName)
+	r.Stamps = append(r.Stamps, newPageStamp(page, text))
+	for word, offsets := range indexPage(text, true) {
+		postings := &PostingList{}
+		if old, ok := r.Postings[word]; ok {
+			// `slices.Clip` makes `append` copy rather than write into the old index's arrays.
+			*postings = PostingList{Pages: slices.Clip(old.Pages), Ends: slices.Clip(old.Ends), Offsets: slices.Clip(old.Offsets)}
+		}
+		postings.Pages = append(postings.Pages, pageIndex)
+		postings.Offsets = append(postings.Offsets, offsets...)
+		postings.Ends = append(postings.Ends, uint32(len(postings.Offsets)))
+		r.Postings[word] = postings
+	}
+	return r, nil
+}
+
+// WithoutPage returns a copy of the index without the page called `fileName`, if it has one.
+// As with `WithPage`, the copy shares posting lists with the original.
+func (index *Index) WithoutPage(fileName string) *Index {
+	r := &Index{
+		Version:   index.Version,
+		FileNames: slices.Clone(index.FileNames),
+		Stamps:    slices.Clone(index.Stamps),
+		Postings:  maps.Clone(index.Postings),
+	}
+
+	i := slices.Index(r.FileNames, fileName)
+	if i == -1 {
+		return r
+	}
+	// Later pages keep their places, so that only the posting lists of the page's own words
+	// have to change.
+	r.FileNames[i] = ""
+	r.Stamps[i] = PageStamp{}
+
+	pageIndex := uint32(i)
+	for word, postings := range r.Postings {
+		j, found := slices.BinarySearch(postings.Pages, pageIndex)
+		if !found {
+			continue
+		}
+
+		if len(postings.Pages) == 1 {
+			delete(r.Postings, word)
+			continue
+		}
+
+		start := uint32(0)
+		if j > 0 {
+			start = postings.Ends[j-1]
+		}
+		end := postings.Ends[j]
+		ends := make([]uint32, 0, len(postings.Ends)-1)
+		ends = append(ends, postings.Ends[:j]...)
+		for _, e := range postings.Ends[j+1:] {
+			ends = append(ends, e-(end-start))
+		}
+		r.Postings[word] = &PostingList{
+			Pages:   slices.Delete(slices.Clone(postings.Pages), j, j+1),
+			Ends:    ends,
+			Offsets: slices.Delete(slices.Clone(postings.Offsets), int(start), int(end)),
+		}
+	}
+	return r
+}
+
+func (index *Index) Save(path string) error {
+	// write to a temporary file first so that a crash can't leave a truncated index behind
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(file).Encode(index)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func LoadIndex(path string) (*Index, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	index := &Index{}
+	err = gob.NewDecoder(file).Decode(index)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode index: %w", err)
+	}
+	return index, nil
+}
+
+// LoadOrBuildIndex loads the index saved in `directory` (next to `manifest.json`), or, if
+// there isn't one or it is out of date, builds a new one and saves it there.
+func LoadOrBuildIndex(directory string, pages Pages) (*Index, error) {
+	return LoadOrBuildIndexAt(fmt.Sprintf("%s/%s", directory, INDEX_FILE_NAME), pages)
+}
+
+// LoadOrBuildIndexAt is like `LoadOrBuildIndex`, but the index is kept at `path`.
+func LoadOrBuildIndexAt(path string, pages Pages) (*Index, error) {
+	index, err := LoadIndex(path)
+	if err == nil && !index.IsStale(pages) {
+		log.Printf("loaded index from %s", path)
+		return index, nil
+	}
+
+	if err == nil {
+		log.Printf("index at %s is stale, rebuilding", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("could not load index from %s, rebuilding (%s)", path, err)
+	}
+
+	index = BuildIndex(pages)
+	err = index.Save(path)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
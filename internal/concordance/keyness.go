@@ -0,0 +1,160 @@
+package concordance
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type KeynessOptions struct {
+	// maximum number of keywords to return
+	Limit int
+	// ignore words that occur fewer than this many times in the target corpus
+	MinCount int
+}
+
+type Keyword struct {
+	Word          string  `json:"word"`
+	CountA        int     `json:"count_a"`
+	CountB        int     `json:"count_b"`
+	LogLikelihood float64 `json:"log_likelihood"`
+	LogRatio      float64 `json:"log_ratio"`
+}
+
+type Keyness struct {
+	Keywords []Keyword `json:"keywords"`
+	BooksA   int       `json:"books_a"`
+	BooksB   int       `json:"books_b"`
+	WordsA   int       `json:"words_a"`
+	WordsB   int       `json:"words_b"`
+	// true if `quitChannel` was closed before all the pages were counted
+	Partial bool `json:"partial"`
+}
+
+// CompareKeyness returns the words that are most overrepresented in the target corpus `a`
+// compared to the reference corpus `b`, ranked by log-likelihood (how confident we are
+// that the difference isn't chance) with ties broken by log-ratio (how big the difference
+// is).
+func CompareKeyness(a Pages, b Pages, options KeynessOptions, quitChannel chan struct{}) Keyness {
+	freqsA, wordsA, partialA := countWordFrequencies(a.Pages, quitChannel)
+	freqsB, wordsB, partialB := countWordFrequencies(b.Pages, quitChannel)
+
+	keyness := Keyness{
+		Keywords: []Keyword{},
+		BooksA:   len(a.Pages),
+		BooksB:   len(b.Pages),
+		WordsA:   wordsA,
+		WordsB:   wordsB,
+		Partial:  partialA || partialB,
+	}
+	if wordsA == 0 || wordsB == 0 {
+		return keyness
+	}
+
+	for word, countA := range freqsA {
+		if countA < options.MinCount {
+			continue
+		}
+
+		countB := freqsB[word]
+		// only interested in words that are overrepresented in `a`
+		if float64(countA)/float64(wordsA) <= float64(countB)/float64(wordsB) {
+			continue
+		}
+
+		keyness.Keywords = append(keyness.Keywords, Keyword{
+			Word:          word,
+			CountA:        countA,
+			CountB:        countB,
+			LogLikelihood: logLikelihood(countA, countB, wordsA, wordsB),
+			LogRatio:      logRatio(countA, countB, wordsA, wordsB),
+		})
+	}
+
+	sort.Slice(keyness.Keywords, func(i, j int) bool {
+		ki := keyness.Keywords[i]
+		kj := keyness.Keywords[j]
+		if ki.LogLikelihood != kj.LogLikelihood {
+			return ki.LogLikelihood > kj.LogLikelihood
+		}
+		if ki.LogRatio != kj.LogRatio {
+			return ki.LogRatio > kj.LogRatio
+		}
+		return ki.Word < kj.Word
+	})
+
+	if options.Limit > 0 && len(keyness.Keywords) > options.Limit {
+		keyness.Keywords = keyness.Keywords[:options.Limit]
+	}
+	return keyness
+}
+
+// Dunning's log-likelihood (G2), as in Rayson & Garside (2000).
+func logLikelihood(countA int, countB int, wordsA int, wordsB int) float64 {
+	a := float64(countA)
+	b := float64(countB)
+	c := float64(wordsA)
+	d := float64(wordsB)
+
+	expectedA := c * (a + b) / (c + d)
+	expectedB := d * (a + b) / (c + d)
+	ll := 0.0
+	if a > 0 {
+		ll += a * math.Log(a/expectedA)
+	}
+	if b > 0 {
+		ll += b * math.Log(b/expectedB)
+	}
+	return 2 * ll
+}
+
+// Hardie's log-ratio: the binary log of the ratio of relative frequencies. Zero counts are
+// replaced with 0.5 so that words absent from `b` don't have an infinite ratio.
+func logRatio(countA int, countB int, wordsA int, wordsB int) float64 {
+	a := max(float64(countA), 0.5)
+	b := max(float64(countB), 0.5)
+	return math.Log2((a / float64(wordsA)) / (b / float64(wordsB)))
+}
+
+func countWordFrequencies(pages []Page, quitChannel chan struct{}) (map[string]int, int, bool) {
+	var mu sync.Mutex
+	freqs := make(map[string]int)
+	total := 0
+	partial := false
+
+	forEachPage(pages, 0, func(_ int, page Page) {
+		select {
+		case <-quitChannel:
+			mu.Lock()
+			partial = true
+			mu.Unlock()
+			return
+		default:
+		}
+
+		text, release, ok := loadPageText(page)
+		if !ok {
+			return
+		}
+		if release != nil {
+			defer release()
+		}
+
+		pageFreqs := make(map[string]int)
+		n := AddWordFrequencies(text, pageFreqs)
+
+		mu.Lock()
+		defer mu.Unlock()
+		for word, count := range pageFreqs {
+			if _, ok := freqs[word]; !ok && release != nil {
+				// the key will outlive the mapping
+				word = strings.Clone(word)
+			}
+			freqs[word] += count
+		}
+		total += n
+	})
+
+	return freqs, total, partial
+}
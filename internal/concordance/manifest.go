@@ -0,0 +1,35 @@
+package concordance
+
+import "encoding/json"
+
+// ManifestEntry is the metadata for a single book, as written to `manifest.json` by
+// `scraping/scrape_standard_ebooks.py`.
+type ManifestEntry struct {
+	Title    string   `json:"title"`
+	Author   string   `json:"author"`
+	Url      string   `json:"url"`
+	Year     int      `json:"year,omitempty"`
+	Subjects []string `json:"subjects,omitempty"`
+	Language string   `json:"language,omitempty"`
+}
+
+// Manifest maps a book's directory name (`Page.FileName`) to its metadata.
+type Manifest map[string]ManifestEntry
+
+func ParseManifest(data []byte) (Manifest, error) {
+	manifest := Manifest{}
+	err := json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Decade returns the decade the book was published in (e.g., 1890 for 1897), or 0 if the
+// publication year is not known.
+func (entry ManifestEntry) Decade() int {
+	if entry.Year == 0 {
+		return 0
+	}
+	return entry.Year - entry.Year%10
+}
@@ -0,0 +1,163 @@
+package concordance
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const MIN_NGRAM_LENGTH = 2
+const MAX_NGRAM_LENGTH = 5
+const NGRAM_EXAMPLES = 3
+
+// ErrNgramLength is returned by `CountNgrams` for an `n` out of range, or no longer than the
+// keyword.
+var ErrNgramLength = errors.New("invalid n-gram length")
+
+type NgramPosition int
+
+const (
+	// n-grams that begin with the keyword, e.g. "vampire ___ ___"
+	NGRAM_START NgramPosition = iota
+	// n-grams that end with the keyword, e.g. "___ ___ vampire"
+	NGRAM_END
+)
+
+func ParseNgramPosition(s string) (NgramPosition, error) {
+	switch s {
+	case "start":
+		return NGRAM_START, nil
+	case "end":
+		return NGRAM_END, nil
+	default:
+		return NGRAM_START, fmt.Errorf("unknown n-gram position: %q", s)
+	}
+}
+
+type Ngram struct {
+	Text     string  `json:"ngram"`
+	Count    int     `json:"count"`
+	Examples []Match `json:"examples"`
+}
+
+type Ngrams struct {
+	Ngrams []Ngram `json:"ngrams"`
+	// number of hits for the keyword, including those without enough context for an n-gram
+	Hits int `json:"hits"`
+	// true if `quitChannel` was closed before the search finished, in which case the
+	// counts are only for the hits found so far
+	Partial bool `json:"partial"`
+}
+
+// CountNgrams counts the `n`-word sequences (including the words of the keyword itself)
+// that begin or end with `keyword`, using the context of each hit. At most `limit` n-grams
+// are returned, most frequent first.
+func CountNgrams(pages Pages, keyword string, n int, position NgramPosition, limit int, quitChannel chan struct{}) (Ngrams, error) {
+	keywordWords := strings.Fields(strings.ToLower(keyword))
+	contextWords := n - len(keywordWords)
+	if n < MIN_NGRAM_LENGTH || n > MAX_NGRAM_LENGTH || contextWords < 1 {
+		return Ngrams{}, fmt.Errorf("%w: must be between %d and %d and longer than the keyword", ErrNgramLength, MIN_NGRAM_LENGTH, MAX_NGRAM_LENGTH)
+	}
+
+	ch, _, err := StreamSearch(pages, keyword, quitChannel, SearchOptions{})
+	if err != nil {
+		return Ngrams{}, err
+	}
+
+	result := Ngrams{Ngrams: []Ngram{}}
+	counts := make(map[string]*Ngram)
+	for batch := range ch {
+		for _, match := range batch {
+			result.Hits += 1
+
+			var words []string
+			if position == NGRAM_START {
+				words = contextWordsAfter(match.Right, contextWords)
+			} else {
+				words = contextWordsBefore(match.Left, contextWords)
+			}
+			if words == nil {
+				continue
+			}
+
+			var text string
+			if position == NGRAM_START {
+				text = strings.Join(slices.Concat(keywordWords, words), " ")
+			} else {
+				text = strings.Join(slices.Concat(words, keywordWords), " ")
+			}
+
+			ngram, ok := counts[text]
+			if !ok {
+				ngram = &Ngram{Text: text, Examples: []Match{}}
+				counts[text] = ngram
+			}
+			ngram.Count += 1
+			if len(ngram.Examples) < NGRAM_EXAMPLES {
+				ngram.Examples = append(ngram.Examples, match)
+			}
+		}
+	}
+
+	select {
+	case <-quitChannel:
+		result.Partial = true
+	default:
+	}
+
+	for _, ngram := range counts {
+		result.Ngrams = append(result.Ngrams, *ngram)
+	}
+	sort.Slice(result.Ngrams, func(i, j int) bool {
+		if result.Ngrams[i].Count != result.Ngrams[j].Count {
+			return result.Ngrams[i].Count > result.Ngrams[j].Count
+		}
+		return result.Ngrams[i].Text < result.Ngrams[j].Text
+	})
+	if limit > 0 && len(result.Ngrams) > limit {
+		result.Ngrams = result.Ngrams[:limit]
+	}
+
+	return result, nil
+}
+
+// contextWordsAfter returns the first `n` words of the right context, or nil if it doesn't
+// have that many. A word that runs up to the edge of the context window is discarded, since
+// it may have been cut off.
+func contextWordsAfter(right string, n int) []string {
+	words := []string{}
+	i := 0
+	for len(words) < n {
+		start, end := nextWord(right, i)
+		if start == -1 || end == len(right) {
+			return nil
+		}
+		words = append(words, strings.ToLower(right[start:end]))
+		i = end
+	}
+	return words
+}
+
+// contextWordsBefore returns the last `n` words of the left context, or nil if it doesn't
+// have that many.
+func contextWordsBefore(left string, n int) []string {
+	words := []string{}
+	i := 0
+	for {
+		start, end := nextWord(left, i)
+		if start == -1 {
+			break
+		}
+		if start != 0 {
+			words = append(words, strings.ToLower(left[start:end]))
+		}
+		i = end
+	}
+
+	if len(words) < n {
+		return nil
+	}
+	return words[len(words)-n:]
+}
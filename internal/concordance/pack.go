@@ -0,0 +1,148 @@
+package concordance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/iafisher/fast-concordance/internal/mmapfile"
+)
+
+// A packed corpus is a blob file (see `blobfile.go`) with one section: the text of every
+// page. The header holds the page boundaries and the manifest, so a packed corpus can be
+// loaded from a single file without the directory it was made from.
+const PACKED_MAGIC = "FCPACKED"
+const PACKED_FILE_NAME = "corpus.pack"
+
+type packedHeader struct {
+	Pages    []blobPage      `json:"pages"`
+	TextLen  int             `json:"text_len"`
+	Manifest json.RawMessage `json:"manifest"`
+}
+
+// packedCorpus is the text of a corpus loaded by `LoadPacked`, as one string.
+type packedCorpus struct {
+	text  string
+	pages []blobPage
+}
+
+// WritePacked writes `pages` and their manifest to `path` as a packed corpus.
+func WritePacked(pages Pages, path string) error {
+	text, blobPages, err := concatenatePages(pages)
+	if err != nil {
+		return err
+	}
+
+	header := packedHeader{Pages: blobPages, TextLen: len(text), Manifest: pages.ManifestJson}
+	return writeBlobFile(path, PACKED_MAGIC, header, text)
+}
+
+// LoadPacked memory-maps a packed corpus written by `WritePacked`. The pages' text points
+// into the mapped file, so it must not be used after `Pages.Close`.
+func LoadPacked(path string) (Pages, error) {
+	file, err := mmapfile.Open(path)
+	if err != nil {
+		return Pages{}, err
+	}
+
+	pages, err := parsePacked(file.Data)
+	if err != nil {
+		file.Close()
+		return Pages{}, fmt.Errorf("could not load packed corpus from %s: %w", path, err)
+	}
+	pages.mappedFiles = []*mmapfile.File{file}
+	return pages, nil
+}
+
+func parsePacked(data []byte) (Pages, error) {
+	var header packedHeader
+	offset, err := parseBlobFile(data, PACKED_MAGIC, &header)
+	if err != nil {
+		return Pages{}, err
+	}
+
+	if alignTo4(offset+header.TextLen) != len(data) {
+		return Pages{}, errors.New("file size does not match header")
+	}
+
+	manifest, err := ParseManifest(header.Manifest)
+	if err != nil {
+		return Pages{}, fmt.Errorf("could not parse manifest: %w", err)
+	}
+
+	packed := &packedCorpus{text: bytesToString(data[offset : offset+header.TextLen]), pages: header.Pages}
+	pages := make([]Page, 0, len(header.Pages))
+	for _, p := range header.Pages {
+		if p.Start > p.End || p.End > header.TextLen {
+			return Pages{}, errors.New("page boundaries out of range")
+		}
+		pages = append(pages, Page{FileName: p.FileName, Text: packed.text[p.Start:p.End], lazyWordCount: &lazyWordCount{}})
+	}
+
+	return Pages{Pages: pages, Manifest: manifest, ManifestJson: header.Manifest, packed: packed}, nil
+}
+
+// pageAt returns the index of the page that contains `offset` in the packed text.
+func (packed *packedCorpus) pageAt(offset int) int {
+	return sort.Search(len(packed.pages), func(i int) bool {
+		return packed.pages[i].End > offset
+	})
+}
+
+// searchPacked is like `searchPages`, but it splits the packed text into chunks regardless
+// of where the pages begin and end, so that many small books can share a chunk. Hits are
+// mapped back to their page before the word-boundary check, so the results are the same as
+// a per-page search.
+func searchPacked(packed *packedCorpus, finder IFinder, overlap int, chunkSize int, options SearchOptions, stats *SearchStats, quitChannel chan struct{}, emit func(batch []Match) bool) {
+	limits := newPageLimits(len(packed.pages), options.PerPageLimit)
+	scanned := make([]atomic.Bool, len(packed.pages))
+
+	text := packed.text
+	chunks := (len(text) + chunkSize - 1) / chunkSize
+	forEach(chunks, options.MaxGoroutines, func(i int) {
+		select {
+		case <-quitChannel:
+			return
+		default:
+		}
+
+		chunkStart := i * chunkSize
+		chunkEnd := min(chunkStart+chunkSize, len(text))
+		for j := packed.pageAt(chunkStart); j < min(packed.pageAt(chunkEnd-1)+1, len(packed.pages)); j++ {
+			scanned[j].Store(true)
+		}
+
+		searchChunk(stats, func(counts *chunkCounts) {
+			b := batcher{emit: counts.unmetered(emit)}
+			findInChunk(finder, text, chunkStart, chunkEnd, overlap, counts, func(start int, end int) bool {
+				pageIndex := packed.pageAt(start)
+				if pageIndex == len(packed.pages) {
+					return true
+				}
+				p := packed.pages[pageIndex]
+				if start < p.Start || end > p.End {
+					return true
+				}
+
+				pageText := text[p.Start:p.End]
+				start -= p.Start
+				end -= p.Start
+				if !counts.onWordBoundaries(pageText, start, end) {
+					return true
+				}
+
+				if !limits.allow(pageIndex) {
+					return true
+				}
+
+				return b.add(matchAt(finder, p.FileName, pageText, start, end))
+			})
+			b.flush()
+		})
+	})
+
+	limits.report(stats, func(i int) string { return packed.pages[i].FileName })
+	stats.PagesScanned = countScanned(scanned)
+}
@@ -0,0 +1,160 @@
+package concordance
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"sync"
+)
+
+// PageCache keeps the text of recently searched pages in memory, up to `MaxBytes`, for pages
+// loaded by `LoadPagesCached`. It is a middle ground between reading every page on every
+// query (`LoadPages` with `fileNamesOnly`) and holding the whole corpus in memory.
+type PageCache struct {
+	MaxBytes int64
+	size     int64
+	// most recently used at the front
+	items  *list.List
+	byPath map[string]*list.Element
+	// counts calls to `Forget` and `Clear`; `forgotten` holds the value it had when each path
+	// was last forgotten, and `cleared` when the cache was last cleared, so that `put` can
+	// tell that text read before then is stale
+	generation uint64
+	forgotten  map[string]uint64
+	cleared    uint64
+	stats      PageCacheStats
+	mu         sync.Mutex
+}
+
+type PageCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Pages     int   `json:"pages"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+}
+
+type pageCacheItem struct {
+	path string
+	text string
+}
+
+func NewPageCache(maxBytes int64) *PageCache {
+	return &PageCache{
+		MaxBytes:  maxBytes,
+		items:     list.New(),
+		byPath:    make(map[string]*list.Element),
+		forgotten: make(map[string]uint64),
+	}
+}
+
+// LoadPagesCached is like `LoadPages` with `fileNamesOnly`, except that the pages' text is
+// read through `cache`.
+func LoadPagesCached(directory string, limit int, cache *PageCache) (Pages, error) {
+	pages, err := loadPages(directory, true, limit, false, nil)
+	if err != nil {
+		return Pages{}, err
+	}
+
+	for i := range pages.Pages {
+		pages.Pages[i].cache = cache
+	}
+	return pages, nil
+}
+
+// get returns the text of the file at `path`, reading it if it isn't in the cache.
+func (cache *PageCache) get(path string) (string, bool) {
+	cache.mu.Lock()
+	if elem, ok := cache.byPath[path]; ok {
+		cache.items.MoveToFront(elem)
+		cache.stats.Hits += 1
+		cache.mu.Unlock()
+		return elem.Value.(*pageCacheItem).text, true
+	}
+	cache.stats.Misses += 1
+	generation := cache.generation
+	cache.mu.Unlock()
+
+	// Read without holding the lock, so that misses don't hold up hits. Two queries may read
+	// the same page at once, in which case the second one's copy is kept.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("failed to read file: %s (%s)", path, err)
+		return "", false
+	}
+	text := string(data)
+	cache.put(path, text, generation)
+	return text, true
+}
+
+// put adds `text`, which was read when the cache's generation was `generation`, unless the
+// page has been forgotten since then.
+func (cache *PageCache) put(path string, text string, generation uint64) {
+	if int64(len(text)) > cache.MaxBytes {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.forgotten[path] > generation || cache.cleared > generation {
+		return
+	}
+
+	if elem, ok := cache.byPath[path]; ok {
+		cache.remove(elem)
+	}
+
+	cache.byPath[path] = cache.items.PushFront(&pageCacheItem{path: path, text: text})
+	cache.size += int64(len(text))
+	for cache.size > cache.MaxBytes {
+		// Queries that are still searching the page keep its text alive until they finish.
+		cache.remove(cache.items.Back())
+		cache.stats.Evictions += 1
+	}
+}
+
+// Forget removes the page at `path` from the cache, e.g. because the file has changed. Text
+// that a query was reading at the time isn't added to the cache afterwards.
+func (cache *PageCache) Forget(path string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.generation += 1
+	cache.forgotten[path] = cache.generation
+	if elem, ok := cache.byPath[path]; ok {
+		cache.remove(elem)
+	}
+}
+
+// Clear empties the cache, but keeps its statistics.
+func (cache *PageCache) Clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.items.Init()
+	clear(cache.byPath)
+	cache.size = 0
+	cache.generation += 1
+	cache.cleared = cache.generation
+	// Every path is forgotten as of `cleared`, so the older entries aren't needed.
+	clear(cache.forgotten)
+}
+
+func (cache *PageCache) Stats() PageCacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	stats := cache.stats
+	stats.Pages = cache.items.Len()
+	stats.Bytes = cache.size
+	stats.MaxBytes = cache.MaxBytes
+	return stats
+}
+
+func (cache *PageCache) remove(elem *list.Element) {
+	item := cache.items.Remove(elem).(*pageCacheItem)
+	delete(cache.byPath, item.path)
+	cache.size -= int64(len(item.text))
+}
@@ -0,0 +1,201 @@
+package concordance
+
+// buildSuffixArray returns the suffix array of `text`, using the SA-IS algorithm (Nong,
+// Zhang & Chan, 2009), which runs in linear time. `text` must be shorter than 2^31 bytes.
+func buildSuffixArray(text []byte) []int32 {
+	sa := make([]int32, len(text))
+	sais(text, sa, 256)
+	return sa
+}
+
+// sais fills `sa` with the suffix array of `text`, whose characters are all less than `k`.
+// The end of `text` is treated as a virtual sentinel, smaller than every character.
+func sais[T byte | int32](text []T, sa []int32, k int) {
+	n := len(text)
+	if n == 0 {
+		return
+	}
+	if n == 1 {
+		sa[0] = 0
+		return
+	}
+
+	// isS[i] is true if the suffix at i is S-type (smaller than the suffix at i+1). The last
+	// suffix is always L-type, because of the sentinel.
+	isS := make([]bool, n)
+	for i := n - 2; i >= 0; i-- {
+		isS[i] = text[i] < text[i+1] || (text[i] == text[i+1] && isS[i+1])
+	}
+	isLms := func(i int) bool {
+		return i > 0 && isS[i] && !isS[i-1]
+	}
+
+	// Step 1: sort the LMS substrings by placing the LMS suffixes at the ends of their
+	// buckets and inducing.
+	for i := range sa {
+		sa[i] = -1
+	}
+	bkt := bucketEnds(text, k)
+	for i := 1; i < n; i++ {
+		if isLms(i) {
+			c := text[i]
+			bkt[c] -= 1
+			sa[bkt[c]] = int32(i)
+		}
+	}
+	induceSuffixArray(text, sa, isS, k)
+
+	// Step 2: name the LMS substrings, so that equal substrings get equal names, and
+	// build the reduced string of names in text order.
+	n1 := 0
+	for i := 0; i < n; i++ {
+		if isLms(int(sa[i])) {
+			sa[n1] = sa[i]
+			n1 += 1
+		}
+	}
+	for i := n1; i < n; i++ {
+		sa[i] = -1
+	}
+
+	name := 0
+	prev := -1
+	for i := 0; i < n1; i++ {
+		pos := int(sa[i])
+		if prev == -1 || !lmsSubstringsEqual(text, isS, pos, prev) {
+			name += 1
+			prev = pos
+		}
+		// LMS positions are at least two apart, so `pos/2` is unique.
+		sa[n1+pos/2] = int32(name - 1)
+	}
+
+	j := n - 1
+	for i := n - 1; i >= n1; i-- {
+		if sa[i] >= 0 {
+			sa[j] = sa[i]
+			j -= 1
+		}
+	}
+
+	// Step 3: sort the reduced string, recursing if the names aren't unique yet.
+	s1 := sa[n-n1:]
+	sa1 := sa[:n1]
+	if name < n1 {
+		sais(s1, sa1, name)
+	} else {
+		for i := 0; i < n1; i++ {
+			sa1[s1[i]] = int32(i)
+		}
+	}
+
+	// Step 4: put the LMS suffixes, now in sorted order, at the ends of their buckets and
+	// induce the rest of the suffix array from them.
+	j = 0
+	for i := 1; i < n; i++ {
+		if isLms(i) {
+			s1[j] = int32(i)
+			j += 1
+		}
+	}
+	for i := 0; i < n1; i++ {
+		sa1[i] = s1[sa1[i]]
+	}
+	for i := n1; i < n; i++ {
+		sa[i] = -1
+	}
+
+	bkt = bucketEnds(text, k)
+	for i := n1 - 1; i >= 0; i-- {
+		pos := sa[i]
+		sa[i] = -1
+		c := text[pos]
+		bkt[c] -= 1
+		sa[bkt[c]] = pos
+	}
+	induceSuffixArray(text, sa, isS, k)
+}
+
+func induceSuffixArray[T byte | int32](text []T, sa []int32, isS []bool, k int) {
+	n := len(text)
+
+	// L-type suffixes, left to right. The sentinel's suffix comes first of all, and
+	// induces the last suffix.
+	bkt := bucketStarts(text, k)
+	c := text[n-1]
+	sa[bkt[c]] = int32(n - 1)
+	bkt[c] += 1
+	for i := 0; i < n; i++ {
+		if sa[i] > 0 && !isS[sa[i]-1] {
+			pos := sa[i] - 1
+			c := text[pos]
+			sa[bkt[c]] = pos
+			bkt[c] += 1
+		}
+	}
+
+	// S-type suffixes, right to left
+	bkt = bucketEnds(text, k)
+	for i := n - 1; i >= 0; i-- {
+		if sa[i] > 0 && isS[sa[i]-1] {
+			pos := sa[i] - 1
+			c := text[pos]
+			bkt[c] -= 1
+			sa[bkt[c]] = pos
+		}
+	}
+}
+
+func lmsSubstringsEqual[T byte | int32](text []T, isS []bool, a int, b int) bool {
+	n := len(text)
+	isLms := func(i int) bool {
+		return i > 0 && isS[i] && !isS[i-1]
+	}
+
+	for i := 0; ; i++ {
+		// the sentinel is unique, so a substring that reaches it can't equal another
+		if a+i == n || b+i == n {
+			return false
+		}
+
+		if text[a+i] != text[b+i] || isS[a+i] != isS[b+i] {
+			return false
+		}
+
+		if i > 0 {
+			aEnd := isLms(a + i)
+			bEnd := isLms(b + i)
+			if aEnd || bEnd {
+				return aEnd && bEnd
+			}
+		}
+	}
+}
+
+func bucketStarts[T byte | int32](text []T, k int) []int32 {
+	counts := make([]int32, k)
+	for _, c := range text {
+		counts[c] += 1
+	}
+
+	sum := int32(0)
+	for i, count := range counts {
+		counts[i] = sum
+		sum += count
+	}
+	return counts
+}
+
+func bucketEnds[T byte | int32](text []T, k int) []int32 {
+	counts := make([]int32, k)
+	for _, c := range text {
+		counts[c] += 1
+	}
+
+	sum := int32(0)
+	for i, count := range counts {
+		sum += count
+		counts[i] = sum
+	}
+	return counts
+}
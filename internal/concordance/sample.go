@@ -0,0 +1,104 @@
+package concordance
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+type Sample struct {
+	Matches []Match
+	// number of hits the sample was drawn from
+	Total int
+	// true if `quitChannel` was closed before the search finished, in which case the sample
+	// is only of the hits found so far
+	Partial bool
+}
+
+// reservoir is a uniform random sample of the hits in a single page (Algorithm R).
+type reservoir struct {
+	matches []Match
+	seen    int
+}
+
+func (r *reservoir) add(match Match, size int, rng *rand.Rand) {
+	r.seen += 1
+	if len(r.matches) < size {
+		r.matches = append(r.matches, match)
+	} else if j := rng.IntN(r.seen); j < size {
+		r.matches[j] = match
+	}
+}
+
+// SampleSearch returns a uniform random sample of `size` hits for `keyword` across the whole
+// corpus, regardless of which pages the workers happen to finish first.
+//
+// Each page is sampled independently with its own random stream, and the per-page
+// reservoirs are then merged, so the same `seed` gives the same sample however the pages
+// are scheduled.
+func SampleSearch(pages Pages, keyword string, size int, seed uint64, quitChannel chan struct{}, maxGoroutines int) (Sample, error) {
+	startTime := time.Now()
+
+	finder, err := NewFinder(keyword)
+	if err != nil {
+		return Sample{}, err
+	}
+
+	reservoirs := make([]reservoir, len(pages.Pages))
+	forEachPage(pages.Pages, maxGoroutines, func(i int, page Page) {
+		rng := rand.New(rand.NewPCG(seed, uint64(i)))
+		FindMatches(&finder, page, 0, func(match Match) bool {
+			select {
+			case <-quitChannel:
+				return false
+			default:
+			}
+
+			reservoirs[i].add(match, size, rng)
+			return true
+		})
+	})
+
+	sample := mergeReservoirs(reservoirs, size, rand.New(rand.NewPCG(seed, uint64(len(reservoirs)))))
+	select {
+	case <-quitChannel:
+		sample.Partial = true
+	default:
+	}
+
+	durationMs := time.Since(startTime).Milliseconds()
+	log.Printf("sampled %d of %d hit(s) in %d ms", len(sample.Matches), sample.Total, durationMs)
+	return sample, nil
+}
+
+// mergeReservoirs draws `size` hits without replacement from the union of the pages' hits,
+// picking each page with probability proportional to its number of undrawn hits. Since
+// each reservoir is itself a uniform sample of its page, the result is uniform over all
+// hits.
+func mergeReservoirs(reservoirs []reservoir, size int, rng *rand.Rand) Sample {
+	remaining := make([]int, len(reservoirs))
+	total := 0
+	for i, r := range reservoirs {
+		remaining[i] = r.seen
+		total += r.seen
+	}
+
+	sample := Sample{Matches: []Match{}, Total: total}
+	for undrawn := total; undrawn > 0 && len(sample.Matches) < size; undrawn-- {
+		k := rng.IntN(undrawn)
+		i := 0
+		for k >= remaining[i] {
+			k -= remaining[i]
+			i += 1
+		}
+
+		matches := reservoirs[i].matches
+		j := rng.IntN(len(matches))
+		sample.Matches = append(sample.Matches, matches[j])
+		matches[j] = matches[len(matches)-1]
+		reservoirs[i].matches = matches[:len(matches)-1]
+		remaining[i] -= 1
+	}
+
+	return sample
+}
@@ -0,0 +1,125 @@
+package concordance
+
+import (
+	"log"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// the number of bits in a page's signature for each distinct trigram in the page, which with
+// `SIGNATURE_HASHES` hash functions gives a false-positive rate of about 2% per trigram
+const SIGNATURE_BITS_PER_TRIGRAM = 10
+const SIGNATURE_HASHES = 3
+
+// signature is a Bloom filter of the trigrams (3-byte substrings) of a page. If any trigram
+// of a keyword isn't in it, the keyword can't occur in the page.
+type signature struct {
+	bits []uint64
+	// `len(bits)*64 - 1`, which is one less than a power of two
+	mask uint64
+}
+
+// a set of every possible trigram, for finding a page's distinct trigrams
+type trigramSet [1 << 24 / 64]uint64
+
+var trigramSetPool = sync.Pool{New: func() any { return new(trigramSet) }}
+
+func trigramAt(text string, i int) uint32 {
+	return uint32(text[i])<<16 | uint32(text[i+1])<<8 | uint32(text[i+2])
+}
+
+// trigramHashes returns two independent hashes of `trigram`, which are combined to make
+// the `SIGNATURE_HASHES` hash functions (Kirsch & Mitzenmacher's double hashing).
+func trigramHashes(trigram uint32) (uint64, uint64) {
+	h := uint64(trigram) * 0x9E3779B97F4A7C15
+	return h >> 32, (h ^ h>>29) | 1
+}
+
+func newSignature(text string) *signature {
+	seen := trigramSetPool.Get().(*trigramSet)
+	defer trigramSetPool.Put(seen)
+
+	distinct := []uint32{}
+	for i := 0; i+3 <= len(text); i++ {
+		t := trigramAt(text, i)
+		if seen[t/64]&(1<<(t%64)) == 0 {
+			seen[t/64] |= 1 << (t % 64)
+			distinct = append(distinct, t)
+		}
+	}
+
+	size := max(64, 1<<bits.Len(uint(len(distinct)*SIGNATURE_BITS_PER_TRIGRAM)))
+	sig := &signature{bits: make([]uint64, size/64), mask: uint64(size - 1)}
+	for _, t := range distinct {
+		h1, h2 := trigramHashes(t)
+		for i := uint64(0); i < SIGNATURE_HASHES; i++ {
+			bit := (h1 + i*h2) & sig.mask
+			sig.bits[bit/64] |= 1 << (bit % 64)
+		}
+		// leave the set empty for the next page
+		seen[t/64] = 0
+	}
+	return sig
+}
+
+func (sig *signature) mayContainTrigram(t uint32) bool {
+	h1, h2 := trigramHashes(t)
+	for i := uint64(0); i < SIGNATURE_HASHES; i++ {
+		bit := (h1 + i*h2) & sig.mask
+		if sig.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mayContain returns false if `keyword` definitely doesn't occur in the page. Keywords
+// shorter than a trigram may always occur.
+func (sig *signature) mayContain(keyword string) bool {
+	for i := 0; i+3 <= len(keyword); i++ {
+		if !sig.mayContainTrigram(trigramAt(keyword, i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// BuildSignatures builds the signature of each page whose text is loaded, so that
+// `StreamSearch` can skip pages that can't contain the keyword.
+func BuildSignatures(pages Pages) {
+	startTime := time.Now()
+	var mu sync.Mutex
+	built := 0
+	size := 0
+	forEachPage(pages.Pages, 0, func(i int, page Page) {
+		if len(page.Text) == 0 {
+			return
+		}
+
+		sig := newSignature(page.Text)
+		pages.Pages[i].signature = sig
+
+		mu.Lock()
+		defer mu.Unlock()
+		built += 1
+		size += len(sig.bits) * 8
+	})
+
+	durationMs := time.Since(startTime).Milliseconds()
+	log.Printf("built signatures for %d page(s) (%d KB) in %d ms", built, size/1024, durationMs)
+}
+
+// canSkip returns whether `page` definitely contains none of `keywords`.
+func canSkip(page Page, keywords []string) bool {
+	if page.signature == nil {
+		return false
+	}
+
+	for _, keyword := range keywords {
+		if page.signature.mayContain(keyword) {
+			return false
+		}
+	}
+	return true
+}
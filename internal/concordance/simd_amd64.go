@@ -0,0 +1,64 @@
+package concordance
+
+import (
+	"math/bits"
+	"strings"
+
+	"golang.org/x/sys/cpu"
+)
+
+// a variable so that the tests can exercise the fallback
+var useSimd = cpu.X86.HasAVX2
+
+func HasSimd() bool {
+	return useSimd
+}
+
+// pairMaskAvx2 looks for a block of 32 positions in `text`, starting from 0 and going up in
+// steps of 32, where some position `i` has `text[i] == first` and `text[i+gap] == last`. It
+// returns the start of the block and a bit mask of those positions in it. If there is no
+// such block, it returns the start of the first block that runs past the end of `text`, and
+// 0. Implemented in `simd_amd64.s`.
+//
+//go:noescape
+func pairMaskAvx2(text string, gap int, first byte, last byte) (block int, mask uint32)
+
+// indexSimd returns the index of the first occurrence of `keyword` in `text`, or -1, like
+// `strings.Index`.
+//
+// It compares the first and last bytes of the keyword against 32 positions at once, and
+// only checks the rest of the keyword at positions where both match (Muła's "SIMD-friendly
+// algorithms for substring searching"). That rules out most positions in English text,
+// whatever the length of the keyword.
+func indexSimd(text string, keyword string) int {
+	n := len(keyword)
+	// `strings.IndexByte` is already vectorised for single bytes
+	if !useSimd || n < 2 {
+		return strings.Index(text, keyword)
+	}
+
+	i := 0
+	for {
+		block, mask := pairMaskAvx2(text[i:], n-1, keyword[0], keyword[n-1])
+		if mask == 0 {
+			i += block
+			break
+		}
+
+		for mask != 0 {
+			start := i + block + bits.TrailingZeros32(mask)
+			if text[start:start+n] == keyword {
+				return start
+			}
+			mask &= mask - 1
+		}
+		i += block + 32
+	}
+
+	// the tail of the text, which is too short for a whole block
+	j := strings.Index(text[i:], keyword)
+	if j == -1 {
+		return -1
+	}
+	return i + j
+}
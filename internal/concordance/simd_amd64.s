@@ -0,0 +1,49 @@
+#include "textflag.h"
+
+// func pairMaskAvx2(text string, gap int, first byte, last byte) (block int, mask uint32)
+TEXT ·pairMaskAvx2(SB), NOSPLIT, $0-44
+	MOVQ text_base+0(FP), SI
+	MOVQ text_len+8(FP), DX
+	MOVQ gap+16(FP), CX
+	MOVBQZX first+24(FP), AX
+	MOVBQZX last+25(FP), BX
+
+	// Y0 = first in every byte, Y1 = last in every byte
+	VMOVQ AX, X0
+	VPBROADCASTB X0, Y0
+	VMOVQ BX, X1
+	VPBROADCASTB X1, Y1
+
+	// a block starting at DI reads up to DI + gap + 32, so the last one can start at
+	// R8 = len - gap - 32 (which may be negative)
+	MOVQ DX, R8
+	SUBQ CX, R8
+	SUBQ $32, R8
+	XORQ DI, DI
+
+loop:
+	CMPQ DI, R8
+	JGT  notfound
+	LEAQ (SI)(DI*1), R9
+	VMOVDQU (R9), Y2
+	VMOVDQU (R9)(CX*1), Y3
+	VPCMPEQB Y0, Y2, Y2
+	VPCMPEQB Y1, Y3, Y3
+	VPAND Y2, Y3, Y2
+	VPMOVMSKB Y2, R10
+	TESTL R10, R10
+	JNZ  found
+	ADDQ $32, DI
+	JMP  loop
+
+found:
+	VZEROUPPER
+	MOVQ DI, block+32(FP)
+	MOVL R10, mask+40(FP)
+	RET
+
+notfound:
+	VZEROUPPER
+	MOVQ DI, block+32(FP)
+	MOVL $0, mask+40(FP)
+	RET
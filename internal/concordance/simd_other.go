@@ -0,0 +1,15 @@
+//go:build !amd64
+
+package concordance
+
+import "strings"
+
+var useSimd = false
+
+func HasSimd() bool {
+	return useSimd
+}
+
+func indexSimd(text string, keyword string) int {
+	return strings.Index(text, keyword)
+}
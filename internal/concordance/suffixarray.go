@@ -0,0 +1,176 @@
+package concordance
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+	"unsafe"
+
+	"github.com/iafisher/fast-concordance/internal/mmapfile"
+)
+
+// A suffix array file is a blob file (see `blobfile.go`) with two sections: the text of every
+// page, and the suffix array of that text as int32 offsets.
+const SUFFIX_ARRAY_MAGIC = "FCSUFARR"
+const SUFFIX_ARRAY_FILE_NAME = "suffixarray.bin"
+
+type suffixArrayHeader struct {
+	Pages   []blobPage `json:"pages"`
+	TextLen int        `json:"text_len"`
+}
+
+// SuffixArray is a suffix array over the concatenated text of a corpus. It can count and
+// locate any substring in logarithmic time, including ones in the middle of a word.
+type SuffixArray struct {
+	pages []blobPage
+	text  string
+	sa    []int32
+	file  *mmapfile.File
+}
+
+// WriteSuffixArray builds a suffix array over `pages` and writes it to `path`.
+func WriteSuffixArray(pages Pages, path string) error {
+	startTime := time.Now()
+	text, blobPages, err := concatenatePages(pages)
+	if err != nil {
+		return err
+	}
+
+	if len(text) > math.MaxInt32 {
+		return fmt.Errorf("corpus is too large for a suffix array (%d bytes)", len(text))
+	}
+
+	sa := buildSuffixArray(text)
+	log.Printf("built suffix array of %d byte(s) in %d ms", len(text), time.Since(startTime).Milliseconds())
+
+	saBytes := []byte{}
+	if len(sa) > 0 {
+		saBytes = unsafe.Slice((*byte)(unsafe.Pointer(&sa[0])), len(sa)*4)
+	}
+	header := suffixArrayHeader{Pages: blobPages, TextLen: len(text)}
+	return writeBlobFile(path, SUFFIX_ARRAY_MAGIC, header, text, saBytes)
+}
+
+// LoadSuffixArray memory-maps a file written by `WriteSuffixArray`. The text and suffix
+// array are used in place, not copied into the Go heap.
+func LoadSuffixArray(path string) (*SuffixArray, error) {
+	file, err := mmapfile.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sa, err := parseSuffixArray(file.Data)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not load suffix array from %s: %w", path, err)
+	}
+	sa.file = file
+	return sa, nil
+}
+
+func parseSuffixArray(data []byte) (*SuffixArray, error) {
+	var header suffixArrayHeader
+	offset, err := parseBlobFile(data, SUFFIX_ARRAY_MAGIC, &header)
+	if err != nil {
+		return nil, err
+	}
+
+	textStart := offset
+	offset = alignTo4(offset + header.TextLen)
+	if offset+header.TextLen*4 != len(data) {
+		return nil, errors.New("file size does not match header")
+	}
+
+	r := &SuffixArray{pages: header.Pages}
+	if header.TextLen > 0 {
+		r.text = bytesToString(data[textStart : textStart+header.TextLen])
+		r.sa = unsafe.Slice((*int32)(unsafe.Pointer(&data[offset])), header.TextLen)
+	}
+	return r, nil
+}
+
+func (sa *SuffixArray) Close() error {
+	if sa.file == nil {
+		return nil
+	}
+	return sa.file.Close()
+}
+
+// Pages returns the pages in the suffix array. Their text points into the mapped file, so
+// it must not be used after `Close`.
+func (sa *SuffixArray) Pages() []Page {
+	pages := make([]Page, 0, len(sa.pages))
+	for _, p := range sa.pages {
+		text := sa.text[p.Start:p.End]
+		pages = append(pages, Page{FileName: p.FileName, Text: text, WordCount: CountWords(text)})
+	}
+	return pages
+}
+
+// lookup returns the range of the suffix array whose suffixes begin with `keyword`.
+func (sa *SuffixArray) lookup(keyword string) (int, int) {
+	prefix := func(i int) string {
+		start := int(sa.sa[i])
+		return sa.text[start:min(start+len(keyword), len(sa.text))]
+	}
+
+	lo := sort.Search(len(sa.sa), func(i int) bool {
+		return prefix(i) >= keyword
+	})
+	hi := sort.Search(len(sa.sa), func(i int) bool {
+		return prefix(i) > keyword
+	})
+	return lo, hi
+}
+
+// Count returns the number of times `keyword` occurs in the corpus as a substring, without
+// filtering for word boundaries.
+func (sa *SuffixArray) Count(keyword string) int {
+	if keyword == "" {
+		return 0
+	}
+	lo, hi := sa.lookup(keyword)
+	return hi - lo
+}
+
+// PageOffsets returns the offsets of `keyword` in each page that it occurs in, by file
+// name. The offsets are in increasing order and do not overlap.
+func (sa *SuffixArray) PageOffsets(keyword string) map[string][]uint32 {
+	r := make(map[string][]uint32)
+	if keyword == "" {
+		return r
+	}
+
+	lo, hi := sa.lookup(keyword)
+	positions := make([]int32, hi-lo)
+	copy(positions, sa.sa[lo:hi])
+	sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+
+	pageIndex := 0
+	lastEnd := -1
+	for _, position := range positions {
+		start := int(position)
+		for sa.pages[pageIndex].End <= start {
+			pageIndex += 1
+			lastEnd = -1
+		}
+
+		// to match the other finders, which don't return overlapping occurrences
+		if start < lastEnd {
+			continue
+		}
+
+		// A keyword with the separator in it can match across the end of a page.
+		page := sa.pages[pageIndex]
+		if start+len(keyword) > page.End {
+			continue
+		}
+		lastEnd = start + len(keyword)
+
+		r[page.FileName] = append(r[page.FileName], uint32(start-page.Start))
+	}
+	return r
+}
@@ -0,0 +1,124 @@
+package concordance
+
+import (
+	"sort"
+	"sync"
+)
+
+type TimelineBucket struct {
+	Decade         int     `json:"decade"`
+	Books          int     `json:"books"`
+	Words          int     `json:"words"`
+	Hits           int     `json:"hits"`
+	HitsPerMillion float64 `json:"hits_per_million"`
+}
+
+type Timeline struct {
+	Decades []TimelineBucket `json:"decades"`
+	// books whose publication year is not in the manifest, and so are not in `Decades`
+	UndatedBooks int `json:"undated_books"`
+	UndatedHits  int `json:"undated_hits"`
+	// true if `quitChannel` was closed before the search finished
+	Partial bool `json:"partial"`
+}
+
+// BuildTimeline counts the hits for `keyword` in each decade of publication, normalised
+// by the number of words published in that decade so that decades with more books in the
+// corpus don't dominate.
+func BuildTimeline(pages Pages, keyword string, quitChannel chan struct{}) (Timeline, error) {
+	ch, _, err := StreamSearch(pages, keyword, quitChannel, SearchOptions{})
+	if err != nil {
+		return Timeline{}, err
+	}
+
+	hitsByFile := make(map[string]int)
+	for batch := range ch {
+		for _, match := range batch {
+			hitsByFile[match.FileName] += 1
+		}
+	}
+
+	timeline := Timeline{Decades: []TimelineBucket{}}
+	select {
+	case <-quitChannel:
+		timeline.Partial = true
+	default:
+	}
+
+	buckets := make(map[int]*TimelineBucket)
+	for _, page := range pages.Pages {
+		if !timeline.Partial {
+			select {
+			case <-quitChannel:
+				// Counting the words may mean reading every page, which isn't worth finishing.
+				timeline.Partial = true
+			default:
+			}
+		}
+
+		hits := hitsByFile[page.FileName]
+		decade := pages.Manifest[page.FileName].Decade()
+		if decade == 0 {
+			timeline.UndatedBooks += 1
+			timeline.UndatedHits += hits
+			continue
+		}
+
+		bucket, ok := buckets[decade]
+		if !ok {
+			bucket = &TimelineBucket{Decade: decade}
+			buckets[decade] = bucket
+		}
+		bucket.Books += 1
+		bucket.Hits += hits
+		if !timeline.Partial {
+			bucket.Words += pageWordCount(page)
+		}
+	}
+
+	for _, bucket := range buckets {
+		if bucket.Words > 0 {
+			bucket.HitsPerMillion = float64(bucket.Hits) / float64(bucket.Words) * 1_000_000
+		}
+		timeline.Decades = append(timeline.Decades, *bucket)
+	}
+	sort.Slice(timeline.Decades, func(i, j int) bool {
+		return timeline.Decades[i].Decade < timeline.Decades[j].Decade
+	})
+
+	return timeline, nil
+}
+
+// lazyWordCount holds the word count of a page that wasn't counted when it was loaded, once
+// `pageWordCount` has counted it. Every copy of the `Page` shares it.
+type lazyWordCount struct {
+	once  sync.Once
+	count int
+}
+
+// pageWordCount returns the page's word count, counting it now if it wasn't counted when
+// the page was loaded, and keeping the count if the page has a `lazyWordCount`.
+func pageWordCount(page Page) int {
+	if page.WordCount != 0 {
+		return page.WordCount
+	}
+
+	if page.lazyWordCount == nil {
+		return countPageWords(page)
+	}
+	page.lazyWordCount.once.Do(func() {
+		page.lazyWordCount.count = countPageWords(page)
+	})
+	return page.lazyWordCount.count
+}
+
+func countPageWords(page Page) int {
+	text, release, ok := loadPageText(page)
+	if !ok {
+		return 0
+	}
+	if release != nil {
+		defer release()
+	}
+	return CountWords(text)
+}
@@ -0,0 +1,68 @@
+package concordance
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A word is a maximal run of letters. Unlike `isLetter`, this handles non-ASCII letters,
+// since otherwise words like "café" would be split in two and counted twice.
+func nextWord(text string, i int) (int, int) {
+	start := -1
+	for i < len(text) {
+		b := text[i]
+		var letter bool
+		size := 1
+		if isSingleByteChar(b) {
+			letter = isLetter(b)
+		} else {
+			var r rune
+			r, size = utf8.DecodeRuneInString(text[i:])
+			letter = unicode.IsLetter(r)
+		}
+
+		if letter && start == -1 {
+			start = i
+		} else if !letter && start != -1 {
+			return start, i
+		}
+		i += size
+	}
+
+	if start == -1 {
+		return -1, -1
+	}
+	return start, len(text)
+}
+
+func CountWords(text string) int {
+	n := 0
+	i := 0
+	for {
+		start, end := nextWord(text, i)
+		if start == -1 {
+			break
+		}
+		n += 1
+		i = end
+	}
+	return n
+}
+
+// AddWordFrequencies adds the count of each word in `text`, lower-cased, to `freqs`, and
+// returns the total number of words.
+func AddWordFrequencies(text string, freqs map[string]int) int {
+	n := 0
+	i := 0
+	for {
+		start, end := nextWord(text, i)
+		if start == -1 {
+			break
+		}
+		freqs[strings.ToLower(text[start:end])] += 1
+		n += 1
+		i = end
+	}
+	return n
+}
@@ -0,0 +1,180 @@
+package concordance
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"unsafe"
+
+	"github.com/iafisher/fast-concordance/internal/mmapfile"
+)
+
+var ErrNoSuchPage = errors.New("no such page")
+
+// PagesUpdate is the result of `AddPage` or `RemovePage`: new versions of the pages and their
+// index, which share everything they can with the old ones. The old ones stay valid, so
+// searches that are running on them aren't affected.
+type PagesUpdate struct {
+	Pages Pages
+	// nil if there was no index to update
+	Index *Index
+	// Release unmaps the text of the page that was replaced or removed, if it was mapped. It
+	// must not be called until nothing is using the old pages.
+	Release func()
+}
+
+// AddPage loads the book in `directory/fileName`, along with its entry in the directory's
+// manifest, and adds it to `pages` and `index` (which may be nil), replacing the book if it
+// is already there. If the other pages have signatures (see `BuildSignatures`), so does the
+// new one.
+func AddPage(pages Pages, index *Index, directory string, fileName string, useMmap bool) (PagesUpdate, error) {
+	if fileName == "" || strings.ContainsAny(fileName, "/\\") || fileName == "." || fileName == ".." {
+		return PagesUpdate{}, fmt.Errorf("invalid file name: %q", fileName)
+	}
+
+	_, manifest, err := loadManifest(directory)
+	if err != nil {
+		return PagesUpdate{}, err
+	}
+
+	entry, ok := manifest[fileName]
+	if !ok {
+		return PagesUpdate{}, fmt.Errorf("%s is not in the manifest", fileName)
+	}
+
+	// Pages that are read through a cache stay that way, and the cache mustn't hold on to
+	// the old text of a book that is being replaced.
+	cache := pageCacheOf(pages)
+	page, mappedFile, err := loadPage(directory, fileName, cache != nil, useMmap && cache == nil)
+	if err != nil {
+		return PagesUpdate{}, err
+	}
+	// Until the update holds on to the mapped file, any failure has to unmap it.
+	added := false
+	defer func() {
+		if mappedFile != nil && !added {
+			mappedFile.Close()
+		}
+	}()
+	if cache != nil {
+		// the text isn't read until it is searched, so check that it is there now
+		_, err = os.Stat(page.FilePath)
+		if err != nil {
+			return PagesUpdate{}, err
+		}
+		cache.Forget(page.FilePath)
+		page.cache = cache
+	}
+
+	if hasSignatures(pages) && len(page.Text) > 0 {
+		page.signature = newSignature(page.Text)
+	}
+
+	var newIndex *Index
+	if index != nil {
+		newIndex, err = index.WithPage(page)
+		if err != nil {
+			return PagesUpdate{}, err
+		}
+	}
+
+	update := withoutPage(pages, fileName)
+	update.Index = newIndex
+	if mappedFile != nil {
+		update.Pages.mappedFiles = append(update.Pages.mappedFiles, mappedFile)
+	}
+
+	// Keep the pages in the same order as `LoadPages` would.
+	i, _ := slices.BinarySearchFunc(update.Pages.Pages, fileName, func(page Page, fileName string) int {
+		return strings.Compare(page.FileName, fileName)
+	})
+	update.Pages.Pages = slices.Insert(update.Pages.Pages, i, page)
+
+	update.Pages.Manifest[fileName] = entry
+	err = update.Pages.updateManifestJson()
+	if err != nil {
+		return PagesUpdate{}, err
+	}
+	added = true
+	return update, nil
+}
+
+// RemovePage removes the book called `fileName` from `pages` and `index` (which may be nil),
+// and from the manifest. It returns `ErrNoSuchPage` if the book isn't in `pages`.
+func RemovePage(pages Pages, index *Index, fileName string) (PagesUpdate, error) {
+	if !slices.ContainsFunc(pages.Pages, func(page Page) bool { return page.FileName == fileName }) {
+		return PagesUpdate{}, fmt.Errorf("%w: %s", ErrNoSuchPage, fileName)
+	}
+
+	update := withoutPage(pages, fileName)
+	if index != nil {
+		update.Index = index.WithoutPage(fileName)
+	}
+
+	delete(update.Pages.Manifest, fileName)
+	err := update.Pages.updateManifestJson()
+	if err != nil {
+		return PagesUpdate{}, err
+	}
+	return update, nil
+}
+
+// withoutPage returns a copy of `pages` without the page called `fileName`, if there is one.
+func withoutPage(pages Pages, fileName string) PagesUpdate {
+	update := PagesUpdate{
+		Pages: Pages{
+			Pages:       make([]Page, 0, len(pages.Pages)+1),
+			Manifest:    maps.Clone(pages.Manifest),
+			mappedFiles: slices.Clone(pages.mappedFiles),
+			// The packed text still has the old page in it, so the pages are searched one by
+			// one from now on.
+			packed: nil,
+		},
+		Release: func() {},
+	}
+
+	for _, page := range pages.Pages {
+		if page.FileName != fileName {
+			update.Pages.Pages = append(update.Pages.Pages, page)
+			continue
+		}
+
+		// The page's text is only unmapped if it has a file to itself, i.e. it wasn't loaded
+		// from a packed corpus.
+		i := slices.IndexFunc(update.Pages.mappedFiles, func(file *mmapfile.File) bool {
+			return len(file.Data) > 0 && len(page.Text) > 0 && unsafe.StringData(page.Text) == &file.Data[0]
+		})
+		if i != -1 {
+			file := update.Pages.mappedFiles[i]
+			update.Pages.mappedFiles = slices.Delete(update.Pages.mappedFiles, i, i+1)
+			update.Release = func() { file.Close() }
+		}
+	}
+	return update
+}
+
+func (pages *Pages) updateManifestJson() error {
+	manifestJson, err := json.Marshal(pages.Manifest)
+	if err != nil {
+		return err
+	}
+	pages.ManifestJson = manifestJson
+	return nil
+}
+
+func pageCacheOf(pages Pages) *PageCache {
+	for _, page := range pages.Pages {
+		if page.cache != nil {
+			return page.cache
+		}
+	}
+	return nil
+}
+
+func hasSignatures(pages Pages) bool {
+	return slices.ContainsFunc(pages.Pages, func(page Page) bool { return page.signature != nil })
+}
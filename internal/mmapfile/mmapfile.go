@@ -0,0 +1,19 @@
+// Package mmapfile maps files into memory read-only, so that large files can be used
+// without reading them into the Go heap.
+package mmapfile
+
+type File struct {
+	// must not be used after `Close`
+	Data  []byte
+	unmap func() error
+}
+
+func (f *File) Close() error {
+	if f.unmap == nil {
+		return nil
+	}
+	err := f.unmap()
+	f.Data = nil
+	f.unmap = nil
+	return err
+}
@@ -0,0 +1,35 @@
+//go:build linux
+
+package mmapfile
+
+import (
+	"os"
+	"syscall"
+)
+
+func Open(path string) (*File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// the mapping stays valid after the file is closed
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := int(info.Size())
+	if size == 0 {
+		// mmap fails on empty files
+		return &File{Data: []byte{}}, nil
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{Data: data, unmap: func() error { return syscall.Munmap(data) }}, nil
+}
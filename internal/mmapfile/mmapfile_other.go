@@ -0,0 +1,14 @@
+//go:build !linux
+
+package mmapfile
+
+import "os"
+
+// Open falls back to reading the whole file on platforms where we don't use mmap.
+func Open(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{Data: data}, nil
+}
@@ -0,0 +1,123 @@
+package querylane
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Lane is a pool of slots that queries hold while they run. A query may take more than one
+// slot, e.g. in proportion to how much work it is expected to do. The lane keeps statistics
+// of how long queries have waited for their slots.
+type Lane struct {
+	name  string
+	size  int64
+	sem   *semaphore.Weighted
+	mu    sync.Mutex
+	stats LaneStats
+}
+
+type LaneStats struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// the slots held by queries that are running, and the number of queries waiting
+	InUse   int64 `json:"in_use"`
+	Waiting int   `json:"waiting"`
+	// the number of queries that have been given slots, and how many of them had to wait
+	Admitted int64 `json:"admitted"`
+	Queued   int64 `json:"queued"`
+	// how long the queries that were given slots waited for them
+	TotalWaitMs float64 `json:"total_wait_ms"`
+	MeanWaitMs  float64 `json:"mean_wait_ms"`
+	MaxWaitMs   float64 `json:"max_wait_ms"`
+}
+
+func NewLane(name string, size int) *Lane {
+	return &Lane{
+		name: name,
+		size: int64(size),
+		sem:  semaphore.NewWeighted(int64(size)),
+	}
+}
+
+func (lane *Lane) Size() int64 {
+	return lane.size
+}
+
+// TryAcquire takes `weight` slots (at most the size of the lane) if they are free, without
+// waiting.
+func (lane *Lane) TryAcquire(weight int64) bool {
+	weight = lane.clamp(weight)
+	if !lane.sem.TryAcquire(weight) {
+		return false
+	}
+
+	lane.mu.Lock()
+	defer lane.mu.Unlock()
+	lane.stats.InUse += weight
+	lane.stats.Admitted += 1
+	return true
+}
+
+// Acquire waits for `weight` slots (at most the size of the lane), or until `ctx` is done,
+// and returns how long it waited.
+func (lane *Lane) Acquire(ctx context.Context, weight int64) (time.Duration, error) {
+	if lane.TryAcquire(weight) {
+		return 0, nil
+	}
+
+	weight = lane.clamp(weight)
+	startTime := time.Now()
+
+	lane.mu.Lock()
+	lane.stats.Waiting += 1
+	lane.mu.Unlock()
+
+	err := lane.sem.Acquire(ctx, weight)
+	wait := time.Since(startTime)
+
+	lane.mu.Lock()
+	defer lane.mu.Unlock()
+	lane.stats.Waiting -= 1
+	if err != nil {
+		return wait, err
+	}
+
+	waitMs := float64(wait.Microseconds()) / 1000
+	lane.stats.InUse += weight
+	lane.stats.Admitted += 1
+	lane.stats.Queued += 1
+	lane.stats.TotalWaitMs += waitMs
+	lane.stats.MaxWaitMs = max(lane.stats.MaxWaitMs, waitMs)
+	return wait, nil
+}
+
+// Release gives back `weight` slots taken by `TryAcquire` or `Acquire`.
+func (lane *Lane) Release(weight int64) {
+	weight = lane.clamp(weight)
+	lane.mu.Lock()
+	lane.stats.InUse -= weight
+	lane.mu.Unlock()
+
+	lane.sem.Release(weight)
+}
+
+func (lane *Lane) Stats() LaneStats {
+	lane.mu.Lock()
+	defer lane.mu.Unlock()
+
+	stats := lane.stats
+	stats.Name = lane.name
+	stats.Size = lane.size
+	if stats.Admitted > 0 {
+		// Queries that didn't wait count as waiting for 0 ms.
+		stats.MeanWaitMs = stats.TotalWaitMs / float64(stats.Admitted)
+	}
+	return stats
+}
+
+func (lane *Lane) clamp(weight int64) int64 {
+	return max(1, min(weight, lane.size))
+}
@@ -0,0 +1,56 @@
+package querylane
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLane(t *testing.T) {
+	lane := NewLane("main", 4)
+
+	if !lane.TryAcquire(3) || lane.TryAcquire(2) {
+		t.Fatal("expected only the first query to get its slots")
+	}
+
+	// more than the lane has is taken as the whole lane
+	acquired := make(chan time.Duration)
+	go func() {
+		wait, err := lane.Acquire(context.Background(), 10)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- wait
+	}()
+
+	for lane.Stats().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	lane.Release(3)
+	wait := <-acquired
+	if wait < 20*time.Millisecond {
+		t.Fatalf("expected to wait for at least 20 ms, waited %v", wait)
+	}
+
+	stats := lane.Stats()
+	if stats.InUse != 4 || stats.Waiting != 0 || stats.Admitted != 2 || stats.Queued != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if stats.MaxWaitMs < 20 || stats.MeanWaitMs != stats.TotalWaitMs/2 {
+		t.Fatalf("unexpected wait times: %+v", stats)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := lane.Acquire(ctx, 1)
+	if err == nil {
+		t.Fatal("expected the query to give up waiting")
+	}
+
+	lane.Release(10)
+	stats = lane.Stats()
+	if stats.InUse != 0 || stats.Waiting != 0 || stats.Admitted != 2 || !lane.TryAcquire(4) {
+		t.Fatalf("unexpected stats after release: %+v", stats)
+	}
+}
@@ -0,0 +1,154 @@
+package resultcache
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/iafisher/fast-concordance/internal/concordance"
+)
+
+// a rough count of the bytes a cached match takes up besides its strings: the `Match` struct
+// itself and the string headers
+const MATCH_OVERHEAD_BYTES = 80
+
+// Entry is the result set of a query: complete, or the first matches up to the query's
+// `max_results` if `Truncated`, in which case `Total` is the number of hits if it is known.
+type Entry struct {
+	Matches    []concordance.Match
+	Suppressed map[string]int
+	Truncated  bool
+	Total      int
+}
+
+type cacheItem struct {
+	key   string
+	entry Entry
+	size  int64
+}
+
+// ResultCache holds the result sets of recent queries, evicting the least recently used ones
+// once they take up more than `MaxBytes`.
+type ResultCache struct {
+	MaxBytes int64
+	size     int64
+	// most recently used at the front
+	items *list.List
+	byKey map[string]*list.Element
+	mu    sync.Mutex
+}
+
+func NewResultCache(maxBytes int64) *ResultCache {
+	return &ResultCache{
+		MaxBytes: maxBytes,
+		items:    list.New(),
+		byKey:    make(map[string]*list.Element),
+	}
+}
+
+// Key returns the cache key for a search for `keyword` with the given options in the
+// `generation`th version of the corpus. Options that don't change the results (e.g.,
+// timeouts, or the finder, since every finder returns the same hits) should be left out.
+// `maxResults` is 0 for a complete result set, which can answer a query with any
+// `max_results`, or else the `max_results` of a truncated one.
+func Key(generation int, keyword string, perBook int, maxResults int) string {
+	// the keyword goes last, since it is the only part that can contain a colon
+	return fmt.Sprintf("%d:%d:%d:%s", generation, perBook, maxResults, keyword)
+}
+
+func (cache *ResultCache) Get(key string) (Entry, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	elem, ok := cache.byKey[key]
+	if !ok {
+		return Entry{}, false
+	}
+	cache.items.MoveToFront(elem)
+	return elem.Value.(*cacheItem).entry, true
+}
+
+// Put adds `entry` to the cache, unless it is bigger than the whole cache. The strings in
+// `entry` are copied, since they may point into memory-mapped texts that can go away.
+func (cache *ResultCache) Put(key string, entry Entry) {
+	entry = cloneEntry(entry)
+	size := entrySize(key, entry)
+	if size > cache.MaxBytes {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if elem, ok := cache.byKey[key]; ok {
+		cache.remove(elem)
+	}
+
+	cache.byKey[key] = cache.items.PushFront(&cacheItem{key: key, entry: entry, size: size})
+	cache.size += size
+	for cache.size > cache.MaxBytes {
+		cache.remove(cache.items.Back())
+	}
+}
+
+// Clear empties the cache.
+func (cache *ResultCache) Clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.items.Init()
+	clear(cache.byKey)
+	cache.size = 0
+}
+
+// Size returns the number of entries in the cache and the bytes they take up.
+func (cache *ResultCache) Size() (int, int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return cache.items.Len(), cache.size
+}
+
+func (cache *ResultCache) remove(elem *list.Element) {
+	item := cache.items.Remove(elem).(*cacheItem)
+	delete(cache.byKey, item.key)
+	cache.size -= item.size
+}
+
+func cloneEntry(entry Entry) Entry {
+	matches := make([]concordance.Match, len(entry.Matches))
+	for i, match := range entry.Matches {
+		matches[i] = concordance.Match{
+			FileName: strings.Clone(match.FileName),
+			Left:     strings.Clone(match.Left),
+			Right:    strings.Clone(match.Right),
+			Pattern:  strings.Clone(match.Pattern),
+		}
+	}
+
+	var suppressed map[string]int
+	if entry.Suppressed != nil {
+		suppressed = make(map[string]int, len(entry.Suppressed))
+		for fileName, n := range entry.Suppressed {
+			suppressed[strings.Clone(fileName)] = n
+		}
+	}
+	return Entry{Matches: matches, Suppressed: suppressed, Truncated: entry.Truncated, Total: entry.Total}
+}
+
+func entrySize(key string, entry Entry) int64 {
+	size := int64(len(key))
+	for _, match := range entry.Matches {
+		size += MatchSize(match)
+	}
+	for fileName := range entry.Suppressed {
+		size += int64(len(fileName) + 8)
+	}
+	return size
+}
+
+// MatchSize returns roughly how many bytes `match` takes up in the cache.
+func MatchSize(match concordance.Match) int64 {
+	return int64(MATCH_OVERHEAD_BYTES + len(match.FileName) + len(match.Left) + len(match.Right) + len(match.Pattern))
+}
@@ -0,0 +1,79 @@
+package resultcache
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/iafisher/fast-concordance/internal/concordance"
+)
+
+func TestResultCache(t *testing.T) {
+	entry := func(n int) Entry {
+		return Entry{Matches: make([]concordance.Match, n)}
+	}
+	keyA := Key(0, "whale", 0, 0)
+	keyB := Key(0, "vampire", 0, 0)
+	keyC := Key(0, "whale", 5, 0)
+
+	// room for two entries of one match each
+	cache := NewResultCache(2*MATCH_OVERHEAD_BYTES + 50)
+	cache.Put(keyA, entry(1))
+	cache.Put(keyB, entry(1))
+	shouldHit(t, cache, keyA, 1)
+
+	// evicts B, the least recently used
+	cache.Put(keyC, entry(1))
+	shouldHit(t, cache, keyA, 1)
+	shouldHit(t, cache, keyC, 1)
+	shouldMiss(t, cache, keyB)
+
+	// replacing an entry frees the space of the old one
+	cache.Put(keyA, entry(2))
+	shouldHit(t, cache, keyA, 2)
+	shouldMiss(t, cache, keyC)
+
+	// too big for the cache
+	cache.Put(keyB, entry(4))
+	shouldMiss(t, cache, keyB)
+	shouldHit(t, cache, keyA, 2)
+
+	n, size := cache.Size()
+	if n != 1 || size != int64(len(keyA)+2*MATCH_OVERHEAD_BYTES) {
+		t.Fatalf("unexpected size: %d entries, %d bytes", n, size)
+	}
+
+	cache.Clear()
+	shouldMiss(t, cache, keyA)
+}
+
+func TestResultCacheCopiesStrings(t *testing.T) {
+	text := strings.Repeat("the whale ", 10)
+	match := concordance.Match{FileName: "a", Left: text[:40], Right: text[45:]}
+	cache := NewResultCache(1024 * 1024)
+	cache.Put("k", Entry{Matches: []concordance.Match{match}, Suppressed: map[string]int{"a": 1}})
+
+	cached, ok := cache.Get("k")
+	if !ok || cached.Matches[0] != match || cached.Suppressed["a"] != 1 {
+		t.Fatalf("unexpected entry: %+v", cached)
+	}
+
+	// the cached match mustn't point into `text`, which may be a memory-mapped file
+	if unsafe.StringData(cached.Matches[0].Left) == unsafe.StringData(text) {
+		t.Fatal()
+	}
+}
+
+func shouldHit(t *testing.T, cache *ResultCache, key string, matches int) {
+	entry, ok := cache.Get(key)
+	if !ok || len(entry.Matches) != matches {
+		t.Fatalf("expected %d match(es) for %q, got: %v, %d", matches, key, ok, len(entry.Matches))
+	}
+}
+
+func shouldMiss(t *testing.T, cache *ResultCache, key string) {
+	_, ok := cache.Get(key)
+	if ok {
+		t.Fatalf("expected %q not to be in the cache", key)
+	}
+}
@@ -0,0 +1,230 @@
+package shard
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/iafisher/fast-concordance/internal/concordance"
+)
+
+// the longest line that is accepted from a shard
+const MAX_LINE_BYTES = 1 << 20
+
+// Shard is one of `Count` disjoint parts of the corpus. Books are assigned to shards by a hash
+// of their file name, so adding or removing a book doesn't move any others.
+type Shard struct {
+	Index int
+	Count int
+}
+
+// Parse parses a shard written as "index/count", e.g. "0/3" for the first of three.
+func Parse(s string) (Shard, error) {
+	indexString, countString, ok := strings.Cut(s, "/")
+	if !ok {
+		return Shard{}, fmt.Errorf("shard must be written as index/count: %q", s)
+	}
+
+	index, err := strconv.Atoi(indexString)
+	if err != nil {
+		return Shard{}, fmt.Errorf("invalid shard index: %q", indexString)
+	}
+	count, err := strconv.Atoi(countString)
+	if err != nil {
+		return Shard{}, fmt.Errorf("invalid shard count: %q", countString)
+	}
+	if count < 1 || index < 0 || index >= count {
+		return Shard{}, fmt.Errorf("shard index must be between 0 and %d: %d", count-1, index)
+	}
+	return Shard{Index: index, Count: count}, nil
+}
+
+func (shard Shard) String() string {
+	return fmt.Sprintf("%d/%d", shard.Index, shard.Count)
+}
+
+// Contains returns whether the book called `fileName` belongs to the shard.
+func (shard Shard) Contains(fileName string) bool {
+	hash := fnv.New32a()
+	hash.Write([]byte(fileName))
+	return int(hash.Sum32()%uint32(shard.Count)) == shard.Index
+}
+
+// Trailer is the part of a shard's trailer line that is merged into the coordinator's.
+type Trailer struct {
+	Partial    bool                    `json:"partial"`
+	Truncated  bool                    `json:"truncated"`
+	Total      int                     `json:"total,omitempty"`
+	Suppressed map[string]int          `json:"suppressed,omitempty"`
+	Cached     bool                    `json:"cached"`
+	Stats      *concordance.QueryStats `json:"stats,omitempty"`
+	Downgraded string                  `json:"downgraded,omitempty"`
+}
+
+// Event is a line of a shard's response, or the reason that the shard failed. Exactly one
+// field other than `Shard` is set, apart from `Downgraded`, which goes with `Warning`.
+type Event struct {
+	// the index of the shard in the list passed to `Search`
+	Shard int
+	// a match, as the shard sent it
+	Match json.RawMessage
+	// "queued" or "ready"
+	Status string
+	// the message of a warning line, e.g. that the shard only sent a sample of the hits, and
+	// for that warning, how the query was downgraded ("sample" or "count")
+	Warning    string
+	Downgraded string
+	Trailer    *Trailer
+	// the last event from a shard that failed before sending its trailer
+	Err error
+}
+
+type statusLine struct {
+	Status string `json:"status"`
+}
+
+type warningLine struct {
+	Warning struct {
+		Message    string `json:"message"`
+		Downgraded string `json:"downgraded"`
+	} `json:"warning"`
+}
+
+type trailerLine struct {
+	Trailer Trailer `json:"trailer"`
+}
+
+type errorLine struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Search sends a request for `path` with `query` to each of `shards` (base URLs such as
+// "http://localhost:8001") and returns the lines of their NDJSON responses, interleaved in
+// the order they arrive, on one channel. The channel is closed once every shard has sent
+// its trailer or failed, and must be read until then. Cancelling `ctx` cancels the requests
+// to the shards, which stop searching; those that hadn't finished fail with `ctx.Err()`.
+//
+// A shard that goes `timeout` without sending anything, whether its response headers or
+// its next line, is given up on and fails with an error that wraps
+// `context.DeadlineExceeded`. A shard that is taking a long time to send a big result is
+// left to finish, and so is one that has said it is queued, until it says it is ready.
+func Search(ctx context.Context, client *http.Client, shards []string, path string, query url.Values, timeout time.Duration) chan Event {
+	outChannel := make(chan Event, 100)
+
+	var wg sync.WaitGroup
+	for i, base := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := searchShard(ctx, client, i, base+path+"?"+query.Encode(), timeout, outChannel)
+			if err != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+				outChannel <- Event{Shard: i, Err: err}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(outChannel)
+	}()
+
+	return outChannel
+}
+
+func searchShard(ctx context.Context, client *http.Client, i int, url string, timeout time.Duration, outChannel chan Event) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	defer timer.Stop()
+	defer func() {
+		if err != nil && timedOut.Load() {
+			err = fmt.Errorf("nothing received for %v: %w", timeout, context.DeadlineExceeded)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), MAX_LINE_BYTES)
+	if resp.StatusCode != http.StatusOK {
+		var message errorLine
+		if scanner.Scan() && json.Unmarshal(scanner.Bytes(), &message) == nil && message.Error.Message != "" {
+			return fmt.Errorf("HTTP %d: %s", resp.StatusCode, message.Error.Message)
+		}
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	timer.Reset(timeout)
+	for scanner.Scan() {
+		// The timer only runs while waiting for the shard, not for `outChannel`'s reader.
+		timer.Stop()
+		line := scanner.Bytes()
+		event := Event{Shard: i}
+		// Every line is a JSON object, and only the status, warning and trailer lines start
+		// with these keys, so the matches don't have to be decoded.
+		if bytes.HasPrefix(line, []byte(`{"status":`)) {
+			var status statusLine
+			err = json.Unmarshal(line, &status)
+			event.Status = status.Status
+		} else if bytes.HasPrefix(line, []byte(`{"warning":`)) {
+			var warning warningLine
+			err = json.Unmarshal(line, &warning)
+			event.Warning = warning.Warning.Message
+			event.Downgraded = warning.Warning.Downgraded
+		} else if bytes.HasPrefix(line, []byte(`{"trailer":`)) {
+			var trailer trailerLine
+			err = json.Unmarshal(line, &trailer)
+			event.Trailer = &trailer.Trailer
+		} else {
+			event.Match = bytes.Clone(line)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid line: %w", err)
+		}
+
+		outChannel <- event
+		if event.Trailer != nil {
+			return nil
+		}
+
+		// A shard that is waiting for a slot may have nothing to send for a while.
+		if event.Status != "queued" {
+			timer.Reset(timeout)
+		}
+	}
+
+	err = scanner.Err()
+	if err == nil {
+		err = errors.New("response ended without a trailer")
+	}
+	return err
+}
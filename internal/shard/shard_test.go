@@ -0,0 +1,154 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	shard, err := Parse("1/3")
+	if err != nil || shard != (Shard{Index: 1, Count: 3}) || shard.String() != "1/3" {
+		t.Fatalf("unexpected shard: %v, %v", shard, err)
+	}
+
+	for _, s := range []string{"", "1", "3/3", "-1/3", "0/0", "a/3", "1/b"} {
+		_, err := Parse(s)
+		if err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	shards := []Shard{{0, 3}, {1, 3}, {2, 3}}
+	counts := make([]int, len(shards))
+	for i := 0; i < 300; i++ {
+		fileName := fmt.Sprintf("book%03d", i)
+		n := 0
+		for j, shard := range shards {
+			if shard.Contains(fileName) {
+				counts[j] += 1
+				n += 1
+			}
+		}
+		if n != 1 {
+			t.Fatalf("%s is in %d shard(s)", fileName, n)
+		}
+	}
+
+	for j, count := range counts {
+		if count < 50 {
+			t.Fatalf("shard %d has only %d of 300 book(s)", j, count)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/concord" || req.URL.Query().Get("w") != "whale" {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(writer, `{"status":"queued"}`)
+		fmt.Fprintln(writer, `{"status":"ready"}`)
+		fmt.Fprintln(writer, `{"filename":"a","left":"the ","right":""}`)
+		fmt.Fprintln(writer, `{"warning":{"message":"Only a sample is shown."}}`)
+		fmt.Fprintln(writer, `{"filename":"b","left":"a ","right":""}`)
+		fmt.Fprintln(writer, `{"trailer":{"partial":true,"suppressed":{"a":2},"cached":false}}`)
+	}))
+	defer good.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(writer, `{"error":{"message":"Unknown finder."}}`)
+	}))
+	defer failing.Close()
+
+	truncated := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(writer, `{"filename":"c","left":"","right":""}`)
+	}))
+	defer truncated.Close()
+
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-unblock:
+		}
+	}))
+	defer slow.Close()
+	defer close(unblock)
+
+	// Takes longer than the timeout to send everything, but never waits that long for a line.
+	streaming := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 8; i++ {
+			fmt.Fprintln(writer, `{"filename":"d","left":"","right":""}`)
+			writer.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+		fmt.Fprintln(writer, `{"trailer":{"partial":false,"cached":false}}`)
+	}))
+	defer streaming.Close()
+
+	// Waits longer than the timeout, but has said that it is queued.
+	queued := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(writer, `{"status":"queued"}`)
+		writer.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprintln(writer, `{"status":"ready"}`)
+		fmt.Fprintln(writer, `{"trailer":{"partial":false,"cached":false}}`)
+	}))
+	defer queued.Close()
+
+	shards := []string{good.URL, failing.URL, truncated.URL, slow.URL, streaming.URL, queued.URL}
+	ch := Search(context.Background(), &http.Client{}, shards, "/concord", url.Values{"w": {"whale"}}, 200*time.Millisecond)
+
+	matches := 0
+	statuses := []string{}
+	warnings := []string{}
+	errs := make([]error, len(shards))
+	var trailer *Trailer
+	for event := range ch {
+		switch {
+		case event.Match != nil:
+			matches += 1
+		case event.Status != "":
+			statuses = append(statuses, event.Status)
+		case event.Warning != "":
+			warnings = append(warnings, event.Warning)
+		case event.Trailer != nil:
+			if event.Shard == 0 {
+				trailer = event.Trailer
+			} else if event.Shard < 4 {
+				t.Fatalf("unexpected trailer from shard %d", event.Shard)
+			}
+		case event.Err != nil:
+			errs[event.Shard] = event.Err
+		}
+	}
+
+	if matches != 11 || len(statuses) != 4 {
+		t.Fatalf("unexpected events: %d match(es), statuses %v", matches, statuses)
+	}
+	if len(warnings) != 1 || warnings[0] != "Only a sample is shown." {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+	if trailer == nil || !trailer.Partial || trailer.Suppressed["a"] != 2 {
+		t.Fatalf("unexpected trailer: %+v", trailer)
+	}
+	if errs[0] != nil || errs[1] == nil || errs[1].Error() != "HTTP 400: Unknown finder." || errs[2] == nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if !errors.Is(errs[3], context.DeadlineExceeded) {
+		t.Fatalf("expected the slow shard to time out, got: %v", errs[3])
+	}
+	if errs[4] != nil || errs[5] != nil {
+		t.Fatalf("expected the streaming and queued shards to finish, got: %v, %v", errs[4], errs[5])
+	}
+}
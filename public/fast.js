@@ -16,7 +16,7 @@ async function search(keyword, resultsOut, statsOut) {
     const startTime = performance.now();
 
     const controller = new AbortController();
-    const httpResult = await fetch(`./concord?w=${encodeURIComponent(keyword)}`, { signal: controller.signal });
+    const httpResult = await fetch(`./concord?w=${encodeURIComponent(keyword)}&max_results=${DISPLAY_LIMIT}`, { signal: controller.signal });
     if (!httpResult.ok) {
         if (httpResult.status === 429) {
             throw { error: { message: RATE_LIMITED_ERROR_MESSAGE } };
@@ -58,6 +58,11 @@ async function search(keyword, resultsOut, statsOut) {
                     } else {
                         console.warn("Unknown status message received from server:", data);
                     }
+                } else if (data.trailer !== undefined) {
+                    statsOut.trailer = data.trailer;
+                } else if (data.warning !== undefined) {
+                    console.warn("Warning received from server:", data.warning.message);
+                    statsOut.warnings.push(data.warning.message);
                 } else {
                     statsOut.queued = false;
                     resultsOut.push(data);
@@ -68,7 +73,8 @@ async function search(keyword, resultsOut, statsOut) {
             }
         }
 
-        if (resultsOut.length >= DISPLAY_LIMIT) {
+        // The server stops at `max_results`, so this is only a safeguard.
+        if (resultsOut.length > DISPLAY_LIMIT) {
             console.log(`Number of results exceeded DISPLAY_LIMIT (${DISPLAY_LIMIT}). Aborting request.`)
             controller.abort();
             done = true;
@@ -92,7 +98,7 @@ class PageView {
     constructor() {
         this.keyword = "";
         this.results = [];
-        this.stats = { millisToFirstResult: null, millisToLastResult: null, queued: false };
+        this.stats = { millisToFirstResult: null, millisToLastResult: null, queued: false, trailer: null, warnings: [] };
         this.error = null;
         this.loading = false;
         this.manifest = null;
@@ -113,7 +119,7 @@ class PageView {
             m(StatsView, { stats: this.stats, resultsCount: this.results.length }),
             showError ? m(ErrorView, { error: this.error }) : null,
             showQueued ? m(QueuedView) : null,
-            showResults ? m(ResultsListView, { keyword: this.keyword, results: this.results, manifest: this.manifest }) : null,
+            showResults ? m(ResultsListView, { keyword: this.keyword, results: this.results, manifest: this.manifest, trailer: this.stats.trailer }) : null,
             showLoading ? m(LoadingView) : null,
         ]);
     }
@@ -124,6 +130,8 @@ class PageView {
         this.stats.millisToFirstResult = null;
         this.stats.millisToLastResult = null;
         this.stats.queued = false;
+        this.stats.trailer = null;
+        this.stats.warnings = [];
         this.error = null;
         this.loading = true;
         search(this.keyword, this.results, this.stats).then(() => {
@@ -198,8 +206,11 @@ class StatsView {
             const lastMs = stats.millisToLastResult.toFixed(1);
             doneAfter = `(done after ${lastMs}ms)`;
         }
-        return m("div.stats",
-            `${resultsCount} result${s} in ${firstMs}ms ${doneAfter}`);
+        const cached = stats.trailer !== null && stats.trailer.cached ? "(cached)" : "";
+        return m("div.stats", [
+            `${resultsCount} result${s} in ${firstMs}ms ${doneAfter} ${cached}`,
+            stats.warnings.map(warning => m("div.warning", warning)),
+        ]);
     }
 }
 
@@ -208,12 +219,14 @@ class ResultsListView {
         const results = vnode.attrs.results;
         const keyword = vnode.attrs.keyword;
         const manifest = vnode.attrs.manifest;
+        const trailer = vnode.attrs.trailer;
         const resultsView = m("div.results", results.slice(0, DISPLAY_LIMIT).map(result => m(ResultView, { result, keyword, manifest })));
-        if (results.length > DISPLAY_LIMIT) {
+        if (results.length > DISPLAY_LIMIT || (trailer !== null && trailer.truncated)) {
+            const total = trailer !== null && trailer.total ? ` (of ${trailer.total})` : "";
             return [
                 resultsView,
                 m("hr"),
-                m("div.truncated", `Hit display limit of ${DISPLAY_LIMIT}. Further results truncated.`)
+                m("div.truncated", `Hit display limit of ${DISPLAY_LIMIT}${total}. Further results truncated.`)
             ];
         } else {
             return resultsView;
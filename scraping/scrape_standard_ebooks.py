@@ -10,7 +10,7 @@ import tempfile
 import time
 import xml.etree.ElementTree as ET
 from html.parser import HTMLParser
-from typing import List
+from typing import List, Optional
 
 
 SLEEP_SECS = 1.5
@@ -102,7 +102,7 @@ def parse_dir_name(name: str) -> dict:
     author = capitalize_author(parts[0].replace("-", " "))
     title = capitalize_title(parts[1].replace("-", " "))
     print(author, title)
-    return dict(author=author, title=title, url="")
+    return dict(author=author, title=title, url="", year=None, subjects=[], language="")
 
 
 def find_or_blank(root, xpath: str) -> str:
@@ -124,6 +124,31 @@ def find_multiple_authors(root) -> List[str]:
     return r
 
 
+DC_NAMESPACE = "{http://purl.org/dc/elements/1.1/}"
+# e.g. "Moby Dick was published in 1851 by Herman Melville."
+published_pattern = re.compile(r"\bwas published in ([0-9]{3,4})\b")
+
+
+def find_year(subpath: pathlib.Path) -> Optional[int]:
+    # The OPF's <dc:date> is when the Standard Ebooks edition was released, not when the
+    # book was first published. The year of first publication is given in the colophon
+    # instead, which comes first if the book was later translated. If there is no colophon,
+    # the year is left blank rather than guessed.
+    colophon_path = subpath / "colophon.xhtml"
+    if not colophon_path.exists():
+        return None
+
+    m = published_pattern.search(html_to_txt(colophon_path.read_text()))
+    if m is None:
+        return None
+
+    return int(m.group(1))
+
+
+def find_subjects(root) -> List[str]:
+    return [node.text for node in root.iter(f"{DC_NAMESPACE}subject") if node.text]
+
+
 def get_manifest_entry_from_dir(subpath: pathlib.Path) -> dict:
     opf_path = subpath / "content.opf"
     if not opf_path.exists():
@@ -154,7 +179,26 @@ def get_manifest_entry_from_dir(subpath: pathlib.Path) -> dict:
         else:
             author = " & ".join(authors)
 
-    return dict(title=title, author=author, url=url)
+    year = find_year(subpath)
+    subjects = find_subjects(root)
+    language = find_or_blank(root, f".//{DC_NAMESPACE}language")
+    return dict(
+        title=title,
+        author=author,
+        url=url,
+        year=year,
+        subjects=subjects,
+        language=language,
+    )
+
+
+def replace_text(path: pathlib.Path, text: str) -> None:
+    # A server started with -mmap shares its pages with the file, so rewriting the file in
+    # place would change the text under a running search. Write a new file and rename it over
+    # the old one instead; the server keeps the old file until it reloads.
+    tmp_path = path.with_name(path.name + ".tmp")
+    tmp_path.write_text(text)
+    os.replace(tmp_path, path)
 
 
 def extract_text(dir: str, *, outdir: str, force: bool, manifest_only: bool) -> None:
@@ -203,11 +247,11 @@ def extract_text(dir: str, *, outdir: str, force: bool, manifest_only: bool) ->
         out_path = out_subdir / "merged.txt"
 
         text = "\n\n".join(plaintext)
-        out_path.write_text(text)
+        replace_text(out_path, text)
         print(f"==> wrote: {out_path}")
         nchars += len(text)
 
-    (outdir / "manifest.json").write_text(json.dumps(manifest))
+    replace_text(outdir / "manifest.json", json.dumps(manifest))
 
     if not manifest_only:
         duration_secs = time.time() - start_time